@@ -19,7 +19,6 @@ require (
 	github.com/danieljoos/wincred v1.2.2 // indirect
 	github.com/dvsekhvalnov/jose2go v1.8.0 // indirect
 	github.com/frankban/quicktest v1.14.6 // indirect
-	github.com/fxamacker/cbor/v2 v2.7.0 // indirect
 	github.com/getsentry/sentry-go v0.27.0 // indirect
 	github.com/go-jose/go-jose/v4 v4.0.5 // indirect
 	github.com/go-logr/logr v1.4.2 // indirect
@@ -77,6 +76,7 @@ require (
 	example.com/gojq_extentions v0.0.0-00010101000000-000000000000
 	github.com/apache/pulsar-client-go v0.14.0
 	github.com/cockroachdb/pebble v1.1.5
+	github.com/fxamacker/cbor/v2 v2.7.0
 	github.com/itchyny/gojq v0.12.16
 	github.com/jnovack/flag v1.16.0
 	github.com/prometheus/client_golang v1.20.5
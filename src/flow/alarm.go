@@ -1,64 +1,191 @@
 package flow
 
 import (
-	"context"
-	"encoding/json"
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"example.com/streaming-metrics/src/prom_metrics"
 
-	"github.com/apache/pulsar-client-go/pulsar"
 	"github.com/sirupsen/logrus"
 )
 
-func Alarm_ticker(namespace *Namespace, monitor_tick_chan chan<- *string) {
-	ticker := time.NewTicker(namespace.interval())
-	defer ticker.Stop()
+/*
+ * Monitor_tick - runs the monitor of namespace, or on a bucket close its on_bucket_close.jq
+ * (and the monitor if monitor_on_bucket_close)
+ */
+type Monitor_tick struct {
+	namespace    string
+	bucket_close bool
+	// queued and running ticks of the same trigger (overlap_policy)
+	runs *monitor_runs
+}
+
+/*
+ * Alarm_ticker - sends the runs of the wall clock monitor of namespace on its schedule,
+ * the boundaries that passed while a run could not be queued are counted as missed
+ */
+func Alarm_ticker(namespace *Namespace, monitor_tick_chan chan<- *Monitor_tick, stop <-chan struct{}) {
+	schedule, err := namespace.monitor_schedule()
+	if err != nil {
+		logrus.Errorf("Alarm_ticker %s: %+v", namespace.Namespace, err)
+		return
+	}
+	runs := &monitor_runs{}
 
-	logrus.Infof("creating monitor: %s %s", namespace.Namespace, namespace.interval().String())
+	next := schedule.next(time.Now())
+	timer := time.NewTimer(time.Until(next) + namespace.schedule_jitter())
+	defer timer.Stop()
+
+	logrus.Infof("creating monitor: %s %s %s (first run %s)", namespace.Namespace, namespace.interval().String(), namespace.Schedule, next.Format(time.RFC3339))
 
 	for {
-		<-ticker.C
+		select {
+		case <-timer.C:
+			if !send_monitor_tick(namespace, runs, false, monitor_tick_chan, stop) {
+				return
+			}
+
+			now := time.Now()
+			missed := 0
+			for next = schedule.next(next); !next.After(now); next = schedule.next(next) {
+				missed++
+			}
+			if missed > 0 {
+				logrus.Warnf("monitor %s: missed %d runs", namespace.Namespace, missed)
+				prom_metrics.Prom_metric.Add_monitors_missed(namespace.Namespace, missed)
+			}
+			timer.Reset(time.Until(next) + namespace.schedule_jitter())
+
+		case <-stop:
+			logrus.Infof("stopping monitor: %s", namespace.Namespace)
+			return
+		}
+	}
+}
+
+// applies the overlap_policy, false once stopped
+func send_monitor_tick(namespace *Namespace, runs *monitor_runs, bucket_close bool, monitor_tick_chan chan<- *Monitor_tick, stop <-chan struct{}) bool {
+	switch namespace.Overlap_policy {
+	case "skip":
+		if runs.queued.Load() > 0 || runs.running.Load() > 0 {
+			logrus.Debugf("monitor %s: skipped, previous run not finished", namespace.Namespace)
+			prom_metrics.Prom_metric.Inc_monitors_skipped(namespace.Namespace, "skip")
+			return true
+		}
+	case "coalesce":
+		if runs.queued.Load() > 0 {
+			logrus.Debugf("monitor %s: coalesced with the queued run", namespace.Namespace)
+			prom_metrics.Prom_metric.Inc_monitors_skipped(namespace.Namespace, "coalesce")
+			return true
+		}
+	}
 
-		monitor_tick_chan <- &namespace.Namespace
+	runs.queued.Add(1)
+	select {
+	case monitor_tick_chan <- &Monitor_tick{namespace: namespace.Namespace, bucket_close: bucket_close, runs: runs}:
 		prom_metrics.Prom_metric.Inc_monitors_ticks(namespace.Namespace)
+		return true
+	case <-stop:
+		runs.queued.Add(-1)
+		return false
 	}
 }
 
-func Alarm(namespaces map[string]*Namespace, monitor_tick_chan <-chan *string, write_chan chan<- *Write_struct) {
-	for monitor := range monitor_tick_chan {
+/*
+ * Alarm_tickers - one Alarm_ticker per namespace with a wall clock monitor,
+ * kept running across reloads while the schedule is unchanged
+ */
 
-		logrus.Debugf("Running monitor: %s", *monitor)
+type Alarm_tickers struct {
+	monitor_tick_chan chan<- *Monitor_tick
+	stops             map[string]chan struct{}
+	schedules         map[string]string
+	running           sync.WaitGroup
+}
 
-		namespace := namespaces[*monitor]
+func New_alarm_tickers(monitor_tick_chan chan<- *Monitor_tick) *Alarm_tickers {
+	return &Alarm_tickers{
+		monitor_tick_chan: monitor_tick_chan,
+		stops:             make(map[string]chan struct{}),
+		schedules:         make(map[string]string),
+	}
+}
 
-		iter := namespace.monitor.Run(namespace.gojq_namespace())
-		for {
-			//fmt.Printf("%#v\n", iter)
-			v, ok := iter.Next()
+func (tickers *Alarm_tickers) Update(all_namespaces map[string]*Namespace) {
+	namespaces := make(map[string]*Namespace, len(all_namespaces))
+	for name, namespace := range all_namespaces {
+		if namespace.monitor_trigger() == "wall_clock" {
+			namespaces[name] = namespace
+		}
+	}
 
-			if !ok {
-				break
-			}
-			if err, ok := v.(error); ok {
-				logrus.Errorf("Alarm %s: %+v", namespace.Namespace, err)
-				continue
-			} else {
-				logrus.Debugf("%+v", v)
-				payload, err := json.Marshal(v)
-				if err != nil {
-					logrus.Errorf("Alarm marshal: %+v", err)
-					continue
-				}
-				write_chan <- &Write_struct{
-					namespace: namespace.Namespace,
-					monitor:   payload,
-				}
-			}
+	for name, stop := range tickers.stops {
+		if namespace, ok := namespaces[name]; !ok || namespace.schedule_key() != tickers.schedules[name] {
+			close(stop)
+			delete(tickers.stops, name)
+			delete(tickers.schedules, name)
+		}
+	}
+
+	for name, namespace := range namespaces {
+		if _, ok := tickers.stops[name]; !ok {
+			stop := make(chan struct{})
+			tickers.stops[name] = stop
+			tickers.schedules[name] = namespace.schedule_key()
+			tickers.running.Add(1)
+			go func(namespace *Namespace) {
+				defer tickers.running.Done()
+				Alarm_ticker(namespace, tickers.monitor_tick_chan, stop)
+			}(namespace)
 		}
 	}
+}
 
+// stops every ticker, once it returns nothing else is sent to monitor_tick_chan
+func (tickers *Alarm_tickers) Stop() {
+	tickers.Update(map[string]*Namespace{})
+	tickers.running.Wait()
+}
+
+func Alarm(pipeline *atomic.Pointer[Pipeline], backfill *Backfill, monitor_tick_chan <-chan *Monitor_tick, write_chan chan<- *Write_struct) {
+	for monitor := range monitor_tick_chan {
+		monitor.runs.dequeued()
+		alarm(pipeline, backfill, monitor, write_chan)
+		monitor.runs.done()
+	}
+}
+
+func alarm(pipeline *atomic.Pointer[Pipeline], backfill *Backfill, monitor *Monitor_tick, write_chan chan<- *Write_struct) {
+	namespace, ok := pipeline.Load().Namespaces[monitor.namespace]
+	if !ok {
+		logrus.Warnf("Alarm %s: namespace no longer exists", monitor.namespace)
+		return
+	}
+
+	if backfill.Active() {
+		logrus.Debugf("Suppressed monitor (backfill): %s", monitor.namespace)
+		prom_metrics.Prom_metric.Inc_monitors_suppressed(monitor.namespace)
+		// the closed buckets stay queued in the store, the first bucket close after the backfill emits them
+		return
+	}
+
+	logrus.Debugf("Running monitor: %s (bucket close %t)", monitor.namespace, monitor.bucket_close)
+
+	var payloads [][]byte
+	if monitor.bucket_close {
+		payloads = namespace.run_bucket_close()
+	} else {
+		payloads = namespace.run_monitor()
+	}
+
+	for _, payload := range payloads {
+		write_chan <- &Write_struct{
+			namespace: namespace.Namespace,
+			monitor:   payload,
+		}
+	}
 }
 
 type Write_struct struct {
@@ -66,21 +193,14 @@ type Write_struct struct {
 	monitor   []byte
 }
 
-func Producer(write_chan <-chan *Write_struct, producer pulsar.Producer) {
+func Producer(write_chan <-chan *Write_struct, sink Sink) {
 	for monitor := range write_chan {
-		producer.SendAsync(
-			context.Background(),
-			&pulsar.ProducerMessage{
-				Payload: monitor.monitor,
-				Key:     monitor.namespace,
-			},
-			send_callback(monitor.namespace),
-		)
+		sink.Send(monitor.namespace, monitor.monitor, send_callback(monitor.namespace))
 	}
 }
 
-func send_callback(namespace string) func(msgID pulsar.MessageID, pm *pulsar.ProducerMessage, err error) {
-	return func(msgID pulsar.MessageID, pm *pulsar.ProducerMessage, err error) {
+func send_callback(namespace string) func(err error) {
+	return func(err error) {
 		if err != nil {
 			prom_metrics.Prom_metric.Inc_monitors_sent(namespace, fmt.Sprintf("%v", err))
 		} else {
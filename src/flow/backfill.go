@@ -0,0 +1,58 @@
+package flow
+
+import (
+	"sync/atomic"
+	"time"
+
+	"example.com/streaming-metrics/src/prom_metrics"
+
+	"github.com/sirupsen/logrus"
+)
+
+/*
+ * Backfill - the source was started from the past, the windows are rebuilt from history
+ * and the monitors are suppressed until the consumers catch up with live data
+ *
+ *	ends when the low watermark of every topic (see Watermark) reaches until, or a tick finds the backlog drained
+ *	A nil *Backfill is never active.
+ */
+
+type Backfill struct {
+	until  time.Time
+	active atomic.Bool
+}
+
+func New_backfill(until time.Time) *Backfill {
+	backfill := &Backfill{
+		until: until,
+	}
+	backfill.active.Store(true)
+	prom_metrics.Prom_metric.Set_backfill(true)
+	logrus.Infof("Backfill: monitors suppressed until the source reaches %v", until)
+
+	return backfill
+}
+
+func (backfill *Backfill) Active() bool {
+	return backfill != nil && backfill.active.Load()
+}
+
+// watermark - low watermark across the topics, a topic still replaying holds it back
+func (backfill *Backfill) advance(watermark time.Time) {
+	if backfill.Active() && !watermark.Before(backfill.until) {
+		backfill.finish("caught up")
+	}
+}
+
+func (backfill *Backfill) idle() {
+	if backfill.Active() {
+		backfill.finish("backlog drained")
+	}
+}
+
+func (backfill *Backfill) finish(reason string) {
+	if backfill.active.CompareAndSwap(true, false) {
+		prom_metrics.Prom_metric.Set_backfill(false)
+		logrus.Infof("Backfill: done (%s), monitors resumed", reason)
+	}
+}
@@ -1,16 +1,20 @@
 package flow
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
+	"io"
+	"sync/atomic"
 	"time"
 
 	"example.com/streaming-metrics/src/prom_metrics"
+	"example.com/streaming-metrics/src/store/memory_store"
 
-	"github.com/apache/pulsar-client-go/pulsar"
 	"github.com/sirupsen/logrus"
 )
 
-func Consumer(consume_chan <-chan pulsar.ConsumerMessage, ack_chan chan<- pulsar.ConsumerMessage, namespaces map[string]*Namespace, filters *Filter_root, tick <-chan time.Time) {
+func Consumer(consume_chan <-chan Message, ack_chan chan<- Message, pipeline *atomic.Pointer[Pipeline], dead_letters *Dead_letters, late_metrics *Late_metrics, watermark *Watermark) {
 	var n_read float64 = 0
 
 	last_instant := time.Now()
@@ -20,26 +24,23 @@ func Consumer(consume_chan <-chan pulsar.ConsumerMessage, ack_chan chan<- pulsar
 
 	for {
 		select {
-		case msg := <-consume_chan:
+		case msg, ok := <-consume_chan:
+			if !ok {
+				return
+			}
 			n_read += 1
 			last_publish_time = msg.PublishTime()
+			watermark.Observe(msg.Topic(), last_publish_time)
 
 			consume_start := time.Now()
+			current := pipeline.Load()
 
-			metrics := filter(msg.Payload(), filters)
+			metrics := filter(msg, current.Filters, dead_letters)
 
 			filter_dur := time.Since(consume_start)
 
 			push_start := time.Now()
-			for i := 0; i < len(metrics); i++ {
-				metric := &metrics[i]
-				prom_metrics.Prom_metric.Inc_namespace_number_filtered_msg(metric.namespace)
-				if namespace, ok := namespaces[metric.namespace]; ok {
-					namespace.push(metric)
-				} else {
-					logrus.Errorf("No namespace named: %s", metric.namespace)
-				}
-			}
+			push_metrics(msg, metrics, current.Namespaces, dead_letters, late_metrics)
 			push_dur := time.Since(push_start)
 			prom_metrics.Prom_metric.Observe_push_time(push_dur)
 			ack_chan <- msg
@@ -48,11 +49,6 @@ func Consumer(consume_chan <-chan pulsar.ConsumerMessage, ack_chan chan<- pulsar
 			prom_metrics.Prom_metric.Observe_filter_time(filter_dur)
 			prom_metrics.Prom_metric.Observe_processing_time(proccess_dur)
 
-		case <-tick:
-			for _, namespace := range namespaces {
-				namespace.tick(last_publish_time)
-			}
-
 		case <-log_tick.C:
 			since := time.Since(last_instant)
 			last_instant = time.Now()
@@ -62,24 +58,63 @@ func Consumer(consume_chan <-chan pulsar.ConsumerMessage, ack_chan chan<- pulsar
 	}
 }
 
-func filter(msg []byte, filters *Filter_root) []Metric {
+func push_metrics(msg Message, metrics []Metric, namespaces map[string]*Namespace, dead_letters *Dead_letters, late_metrics *Late_metrics) {
+	for i := 0; i < len(metrics); i++ {
+		metric := &metrics[i]
+		prom_metrics.Prom_metric.Inc_namespace_number_filtered_msg(metric.namespace)
+		if namespace, ok := namespaces[metric.namespace]; ok {
+			if late := namespace.push(metric); late != nil {
+				late_metrics.Send(late)
+			}
+		} else {
+			logrus.Errorf("No namespace named: %s", metric.namespace)
+			dead_letters.Send("unknown_namespace", msg, "", metric.namespace, fmt.Sprintf("no namespace named: %s", metric.namespace))
+		}
+	}
+}
+
+// integers are kept exact as json.Number (normalized by gojq), a float64 loses the nanoseconds of epoch times
+func unmarshal_payload(payload []byte, v *any) error {
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	if err := decoder.Decode(v); err != nil {
+		return err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return fmt.Errorf("invalid character after top-level value")
+	}
+	return nil
+}
+
+func filter(msg Message, filters *Filter_root, dead_letters *Dead_letters) []Metric {
 	filtered := make([]Metric, 0)
 
 	var msg_json any
 
-	if err := json.Unmarshal(msg, &msg_json); err != nil {
+	if err := unmarshal_payload(msg.Payload(), &msg_json); err != nil {
 		logrus.Errorf("filter unmarshal msg: %+v", err)
+		dead_letters.Send("unmarshal", msg, "", "", err.Error())
 		return filtered
 	}
 
 	// filter_start := time.Now()
 
-	iter := filters.group_filter.Run(msg_json)
+	meta := message_meta(msg)
+
+	// groups.jq is not of a namespace, default jq timeout
+	var budget *Jq_budget
+	ctx, cancel := budget.context()
+	iter := filters.group_filter.RunWithContext(ctx, msg_json, meta)
 
 	v, ok := iter.Next()
+	cancel()
 	if !ok {
 		return filtered
 	}
+	if err, ok := v.(error); ok && budget.exceeded("groups", err) {
+		dead_letters.Send("jq_timeout", msg, "", "", err.Error())
+		return filtered
+	}
 	if _, ok := v.(error); ok {
 		// ignore -- msg is not important for this namespace
 		logrus.Tracef("filter group_filter next err: %+v", v.(error))
@@ -94,30 +129,48 @@ func filter(msg []byte, filters *Filter_root) []Metric {
 
 	default:
 		logrus.Errorf("filter_root did not return string: %+v", v)
+		dead_letters.Send("group_not_string", msg, "", "", fmt.Sprintf("groups.jq did not return a string: %+v", v))
 		return filtered
 	}
 
 	group_filters, ok := filters.groups[group_name]
 	if !ok {
 		logrus.Errorf("filter_root group does not exist: %s", group_name)
+		dead_letters.Send("unknown_group", msg, group_name, "", fmt.Sprintf("group does not exist: %s", group_name))
 		return filtered
 	}
 
 	for _, filter := range group_filters.children {
-		iter := filter.Filter.Run(msg_json)
+		if filter.Budget.Quarantined() {
+			continue
+		}
+
+		ctx, cancel := filter.Budget.context()
+		iter := filter.Filter.RunWithContext(ctx, msg_json, meta)
 
 		v, ok := iter.Next()
+		cancel()
 		if !ok {
 			continue
 		}
+		if err, ok := v.(error); ok && filter.Budget.exceeded("filter", err) {
+			dead_letters.Send("jq_timeout", msg, group_name, filter.Namespace, err.Error())
+			continue
+		}
 		if _, ok := v.(error); ok {
 			// ignore -- msg is not important for this namespace
 			logrus.Tracef("filter next err: %+v", v.(error))
 			continue
 		} else {
-			metric := metric_from_any(v)
-
-			if metric != nil {
+			metric, err := metric_from_any(v)
+
+			if err != nil {
+				logrus.Errorf("%+v", err)
+				dead_letters.Send("malformed_metric", msg, group_name, filter.Namespace, err.Error())
+			} else {
+				metric.publish_time = msg.PublishTime()
+				metric.event_time = msg.EventTime()
+				metric.topic = msg.Topic()
 				filtered = append(filtered, *metric)
 			}
 		}
@@ -129,7 +182,33 @@ func filter(msg []byte, filters *Filter_root) []Metric {
 	return filtered
 }
 
-func Acks(consumer pulsar.Consumer, ack_chan <-chan pulsar.ConsumerMessage) {
+/*
+ * $__meta of groups.jq and filter.jq
+ *
+ *	{"key", "topic", "properties", "publish_time", "event_time" (RFC3339Nano, null if not set), "redelivery_count"}
+ */
+func message_meta(msg Message) map[string]any {
+	properties := make(map[string]any, len(msg.Properties()))
+	for k, v := range msg.Properties() {
+		properties[k] = v
+	}
+
+	var event_time any
+	if !msg.EventTime().IsZero() {
+		event_time = msg.EventTime().Format(time.RFC3339Nano)
+	}
+
+	return map[string]any{
+		"key":              msg.Key(),
+		"topic":            msg.Topic(),
+		"properties":       properties,
+		"publish_time":     msg.PublishTime().Format(time.RFC3339Nano),
+		"event_time":       event_time,
+		"redelivery_count": int(msg.RedeliveryCount()),
+	}
+}
+
+func Acks(source Source, ack_chan <-chan Message) {
 	last_instant := time.Now()
 	tick := time.NewTicker(time.Minute)
 	defer tick.Stop()
@@ -137,9 +216,13 @@ func Acks(consumer pulsar.Consumer, ack_chan <-chan pulsar.ConsumerMessage) {
 	var ack float64 = 0
 	for {
 		select {
-		case msg := <-ack_chan:
+		case msg, ok := <-ack_chan:
+			if !ok {
+				logrus.Infof("Acks done")
+				return
+			}
 
-			if err := consumer.Ack(msg); err != nil {
+			if err := source.Ack(msg); err != nil {
 				logrus.Warnf("consumer.Acks err: %+v", err)
 			}
 			ack++
@@ -154,3 +237,75 @@ func Acks(consumer pulsar.Consumer, ack_chan <-chan pulsar.ConsumerMessage) {
 		}
 	}
 }
+
+/*
+ * Acks only after a checkpoint: the messages are held until the stores are durably
+ * committed (every interval), then acked in bulk.
+ *	cumulative - ack the last message of each topic partition (only safe with a single
+ *	consumer thread on an exclusive/failover subscription)
+ */
+func Checkpoint_acks(source Source, ack_chan <-chan Message, interval time.Duration, cumulative bool) {
+	last_instant := time.Now()
+	log_tick := time.NewTicker(time.Minute)
+	defer log_tick.Stop()
+	checkpoint_tick := time.NewTicker(interval)
+	defer checkpoint_tick.Stop()
+
+	pending := make([]Message, 0, 2000)
+	var ack float64 = 0
+
+	checkpoint := func() {
+		if len(pending) == 0 {
+			return
+		}
+		if err := memory_store.Checkpoint(); err != nil {
+			logrus.Errorf("Checkpoint_acks: %+v (holding %d messages)", err, len(pending))
+			prom_metrics.Prom_metric.Inc_checkpoints("error")
+			return
+		}
+		prom_metrics.Prom_metric.Inc_checkpoints("ok")
+
+		if cumulative {
+			last := make(map[string]Message)
+			for _, msg := range pending {
+				last[msg.Topic()] = msg
+			}
+			for _, msg := range last {
+				if err := source.Ack_cumulative(msg); err != nil {
+					logrus.Warnf("consumer.Acks cumulative err: %+v", err)
+				}
+			}
+		} else {
+			for _, msg := range pending {
+				if err := source.Ack(msg); err != nil {
+					logrus.Warnf("consumer.Acks err: %+v", err)
+				}
+			}
+		}
+
+		prom_metrics.Prom_metric.Add_number_processed_msg(len(pending))
+		ack += float64(len(pending))
+		pending = pending[:0]
+	}
+
+	for {
+		select {
+		case msg, ok := <-ack_chan:
+			if !ok {
+				checkpoint()
+				logrus.Infof("Acks done")
+				return
+			}
+			pending = append(pending, msg)
+
+		case <-checkpoint_tick.C:
+			checkpoint()
+
+		case <-log_tick.C:
+			since := time.Since(last_instant)
+			last_instant = time.Now()
+			logrus.Infof("Ack rate: %.3f msg/s (%d waiting checkpoint)", ack/float64(since/time.Second), len(pending))
+			ack = 0
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package flow
+
+import (
+	"encoding/json"
+	"time"
+
+	"example.com/streaming-metrics/src/prom_metrics"
+
+	"github.com/sirupsen/logrus"
+)
+
+/*
+ * Dead_letters - messages (or metrics) that could not be processed, with the reason
+ *
+ *	reasons: unmarshal - group_not_string - unknown_group - malformed_metric - unknown_namespace - route_key - jq_timeout
+ *	A nil *Dead_letters only logs.
+ *	The payload is kept as json when it is json, else its bytes as they are (base64 payload_bytes).
+ */
+
+type Dead_letters struct {
+	sink Sink
+}
+
+type Dead_letter struct {
+	Reason        string            `json:"reason"`
+	Error         string            `json:"error"`
+	Group         string            `json:"group,omitempty"`
+	Namespace     string            `json:"namespace,omitempty"`
+	Topic         string            `json:"topic"`
+	Publish_time  time.Time         `json:"publish_time"`
+	Properties    map[string]string `json:"properties"`
+	Payload       json.RawMessage   `json:"payload,omitempty"`
+	Payload_bytes []byte            `json:"payload_bytes,omitempty"`
+}
+
+// sink nil only counts the dead letters
+func New_dead_letters(sink Sink) *Dead_letters {
+	return &Dead_letters{
+		sink: sink,
+	}
+}
+
+func (dead_letters *Dead_letters) Send(reason string, msg Message, group string, namespace string, err string) {
+	if dead_letters == nil {
+		return
+	}
+
+	prom_metrics.Prom_metric.Inc_dead_letters(reason)
+
+	if dead_letters.sink == nil {
+		return
+	}
+
+	dead_letter := &Dead_letter{
+		Reason:       reason,
+		Error:        err,
+		Group:        group,
+		Namespace:    namespace,
+		Topic:        msg.Topic(),
+		Publish_time: msg.PublishTime(),
+		Properties:   msg.Properties(),
+	}
+	if json.Valid(msg.Payload()) {
+		dead_letter.Payload = msg.Payload()
+	} else {
+		dead_letter.Payload_bytes = msg.Payload()
+	}
+
+	payload, marshal_err := json.Marshal(dead_letter)
+	if marshal_err != nil {
+		logrus.Errorf("Dead_letters marshal: %+v", marshal_err)
+		return
+	}
+
+	dead_letters.sink.Send(reason, payload, func(err error) {
+		if err != nil {
+			logrus.Errorf("Dead_letters send %s: %+v", reason, err)
+		}
+	})
+}
+
+func (dead_letters *Dead_letters) Close() {
+	if dead_letters == nil || dead_letters.sink == nil {
+		return
+	}
+	if err := dead_letters.sink.Flush(); err != nil {
+		logrus.Errorf("Dead_letters flush: %+v", err)
+	}
+	dead_letters.sink.Close()
+}
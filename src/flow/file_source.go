@@ -0,0 +1,207 @@
+package flow
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const max_file_line_size = 16 * 1024 * 1024
+
+/*
+ * File_message
+ */
+
+type File_message struct {
+	topic        string
+	key          string
+	payload      []byte
+	properties   map[string]string
+	publish_time time.Time
+	event_time   time.Time
+}
+
+// envelope format of each line: {"topic": "", "key": "", "publish_time": RFC3339, "event_time": RFC3339, "properties": {}, "payload": <json>}
+type file_record struct {
+	Topic        string            `json:"topic"`
+	Key          string            `json:"key,omitempty"`
+	Payload      json.RawMessage   `json:"payload"`
+	Properties   map[string]string `json:"properties"`
+	Publish_time time.Time         `json:"publish_time"`
+	Event_time   time.Time         `json:"event_time"`
+}
+
+func (msg *File_message) Topic() string                 { return msg.topic }
+func (msg *File_message) Key() string                   { return msg.key }
+func (msg *File_message) Payload() []byte               { return msg.payload }
+func (msg *File_message) Properties() map[string]string { return msg.properties }
+func (msg *File_message) PublishTime() time.Time        { return msg.publish_time }
+func (msg *File_message) EventTime() time.Time          { return msg.event_time }
+func (msg *File_message) RedeliveryCount() uint32       { return 0 }
+
+/*
+ * File_source - reads JSONL messages from a file ("-" for stdin)
+ *
+ *	format "raw" - each line is a payload
+ *	format "envelope" - each line is a file_record
+ */
+
+type File_source struct {
+	path     string
+	format   string
+	reader   io.ReadCloser
+	messages chan Message
+	done     chan struct{}
+	stopped  sync.Once
+}
+
+func New_file_source(path string, format string) (*File_source, error) {
+	if format != "raw" && format != "envelope" {
+		return nil, fmt.Errorf("New_file_source %s: %s is not a valid format", path, format)
+	}
+
+	var reader io.ReadCloser
+	if path == "-" {
+		reader = io.NopCloser(os.Stdin)
+	} else {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("New_file_source %s: %w", path, err)
+		}
+		reader = f
+	}
+
+	source := &File_source{
+		path:     path,
+		format:   format,
+		reader:   reader,
+		messages: make(chan Message, 2000),
+		done:     make(chan struct{}),
+	}
+
+	go source.read()
+
+	return source, nil
+}
+
+func (source *File_source) read() {
+	defer close(source.messages)
+
+	lines := make(chan []byte, 100)
+	go source.scan(lines)
+
+	line := 0
+	for {
+		select {
+		case buf, ok := <-lines:
+			if !ok {
+				logrus.Infof("File_source %s: read %d lines", source.path, line)
+				return
+			}
+			line++
+
+			msg, err := source.parse_line(buf)
+			if err != nil {
+				logrus.Errorf("File_source %s line %d: %+v", source.path, line, err)
+				continue
+			}
+
+			select {
+			case source.messages <- msg:
+			case <-source.done:
+				return
+			}
+
+		case <-source.done:
+			return
+		}
+	}
+}
+
+// reading may block (stdin), so it is kept apart from read to be able to stop
+func (source *File_source) scan(lines chan<- []byte) {
+	defer close(lines)
+
+	scanner := bufio.NewScanner(source.reader)
+	scanner.Buffer(make([]byte, 0, 64*1024), max_file_line_size)
+
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		buf := make([]byte, len(scanner.Bytes()))
+		copy(buf, scanner.Bytes())
+
+		select {
+		case lines <- buf:
+		case <-source.done:
+			return
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		logrus.Errorf("File_source %s: %+v", source.path, err)
+	}
+}
+
+func (source *File_source) parse_line(line []byte) (*File_message, error) {
+	if source.format == "raw" {
+		return &File_message{
+			topic:        source.path,
+			payload:      line,
+			properties:   map[string]string{},
+			publish_time: time.Now(),
+		}, nil
+	}
+
+	var record file_record
+	if err := json.Unmarshal(line, &record); err != nil {
+		return nil, err
+	}
+	if len(record.Payload) == 0 {
+		return nil, fmt.Errorf("missing payload")
+	}
+	if record.Properties == nil {
+		record.Properties = map[string]string{}
+	}
+
+	if len(record.Topic) == 0 {
+		record.Topic = source.path
+	}
+
+	return &File_message{
+		topic:        record.Topic,
+		key:          record.Key,
+		payload:      record.Payload,
+		properties:   record.Properties,
+		publish_time: record.Publish_time,
+		event_time:   record.Event_time,
+	}, nil
+}
+
+func (source *File_source) Messages() <-chan Message {
+	return source.messages
+}
+
+func (source *File_source) Ack(msg Message) error { return nil }
+
+func (source *File_source) Ack_cumulative(msg Message) error { return nil }
+
+func (source *File_source) Nack(msg Message) {
+	logrus.Warnf("File_source %s: nack is not supported, message dropped", source.path)
+}
+
+func (source *File_source) Stop() {
+	source.stopped.Do(func() { close(source.done) })
+}
+
+func (source *File_source) Close() {
+	source.Stop()
+	source.reader.Close()
+}
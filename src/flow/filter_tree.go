@@ -58,5 +58,8 @@ func (gf *Group_node) Add_child(leaf *Leaf_node) {
  */
 
 type Leaf_node struct {
-	Filter *gojq.Code
+	Namespace string
+	Filter    *gojq.Code
+	// of the namespace, nil uses the default jq timeout
+	Budget *Jq_budget
 }
@@ -0,0 +1,195 @@
+package flow
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+/*
+ * Fixture - declarative test of a namespace (monitors_dir/<namespace>/tests/*.yaml)
+ *
+ *	messages are processed in order (the stores advance with their time),
+ *	then monitor.jq runs at time and its outputs are compared with expected
+ */
+
+type Fixture struct {
+	Description string            `yaml:"description"`
+	Messages    []Fixture_message `yaml:"messages"`
+	Time        string            `yaml:"time"`
+	Expected    []any             `yaml:"expected"`
+}
+
+type Fixture_message struct {
+	Time       string            `yaml:"time"`
+	Topic      string            `yaml:"topic"`
+	Key        string            `yaml:"key"`
+	Properties map[string]string `yaml:"properties"`
+	Payload    any               `yaml:"payload"`
+	Raw        string            `yaml:"raw"`
+}
+
+type Fixture_result struct {
+	Expected []any
+	Actual   []any
+}
+
+func New_fixture(buf []byte) (*Fixture, error) {
+	var fixture Fixture
+
+	decoder := yaml.NewDecoder(strings.NewReader(string(buf)))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&fixture); err != nil {
+		return nil, fmt.Errorf("New_fixture: %w", err)
+	}
+
+	return &fixture, nil
+}
+
+/*
+ * Runs the fixture against namespace (the stores must be fresh)
+ */
+func (fixture *Fixture) Run(namespace string, namespaces map[string]*Namespace, filters *Filter_root) (*Fixture_result, error) {
+	tested, ok := namespaces[namespace]
+	if !ok {
+		return nil, fmt.Errorf("namespace %s not loaded", namespace)
+	}
+
+	current := time.Unix(0, 0)
+
+	for i, fixture_msg := range fixture.Messages {
+		msg, err := fixture_msg.message(current)
+		if err != nil {
+			return nil, fmt.Errorf("message %d: %w", i, err)
+		}
+		current = msg.publish_time
+
+		push_metrics(msg, filter(msg, filters, nil), namespaces, nil, nil)
+		for _, namespace := range namespaces {
+			namespace.tick(current)
+		}
+	}
+
+	if len(fixture.Time) > 0 {
+		t, err := time.Parse(time.RFC3339Nano, fixture.Time)
+		if err != nil {
+			return nil, fmt.Errorf("time: %w", err)
+		}
+		current = t
+	}
+	tested.tick(current)
+
+	result := &Fixture_result{
+		Expected: make([]any, 0, len(fixture.Expected)),
+		Actual:   make([]any, 0),
+	}
+
+	for _, payload := range tested.run_monitor() {
+		var actual any
+		if err := json.Unmarshal(payload, &actual); err != nil {
+			return nil, fmt.Errorf("monitor output: %w", err)
+		}
+		result.Actual = append(result.Actual, actual)
+	}
+
+	for i, expected := range fixture.Expected {
+		normalized, err := normalize_json(expected)
+		if err != nil {
+			return nil, fmt.Errorf("expected %d: %w", i, err)
+		}
+		result.Expected = append(result.Expected, normalized)
+	}
+
+	return result, nil
+}
+
+func (fixture_msg *Fixture_message) message(current time.Time) (*File_message, error) {
+	msg := &File_message{
+		topic:        fixture_msg.Topic,
+		key:          fixture_msg.Key,
+		properties:   fixture_msg.Properties,
+		publish_time: current,
+	}
+	if msg.properties == nil {
+		msg.properties = map[string]string{}
+	}
+
+	if len(fixture_msg.Time) > 0 {
+		t, err := time.Parse(time.RFC3339Nano, fixture_msg.Time)
+		if err != nil {
+			return nil, err
+		}
+		msg.publish_time = t
+	}
+
+	if len(fixture_msg.Raw) > 0 {
+		msg.payload = []byte(fixture_msg.Raw)
+	} else {
+		payload, err := json.Marshal(fixture_msg.Payload)
+		if err != nil {
+			return nil, err
+		}
+		msg.payload = payload
+	}
+
+	return msg, nil
+}
+
+func (result *Fixture_result) Ok() bool {
+	return reflect.DeepEqual(result.Expected, result.Actual)
+}
+
+/*
+ * Line diff of the outputs: "-" expected, "+" actual
+ */
+func (result *Fixture_result) Diff() string {
+	var diff strings.Builder
+
+	for i := 0; i < len(result.Expected) || i < len(result.Actual); i++ {
+		var expected, actual any
+		has_expected, has_actual := i < len(result.Expected), i < len(result.Actual)
+		if has_expected {
+			expected = result.Expected[i]
+		}
+		if has_actual {
+			actual = result.Actual[i]
+		}
+		if has_expected && has_actual && reflect.DeepEqual(expected, actual) {
+			fmt.Fprintf(&diff, "  [%d] %s\n", i, compact_json(expected))
+			continue
+		}
+		if has_expected {
+			fmt.Fprintf(&diff, "- [%d] %s\n", i, compact_json(expected))
+		}
+		if has_actual {
+			fmt.Fprintf(&diff, "+ [%d] %s\n", i, compact_json(actual))
+		}
+	}
+
+	return diff.String()
+}
+
+// yaml values to the same types json.Unmarshal produces
+func normalize_json(v any) (any, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var normalized any
+	if err := json.Unmarshal(b, &normalized); err != nil {
+		return nil, err
+	}
+	return normalized, nil
+}
+
+func compact_json(v any) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%+v", v)
+	}
+	return string(b)
+}
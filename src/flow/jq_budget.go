@@ -0,0 +1,78 @@
+package flow
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"example.com/streaming-metrics/src/prom_metrics"
+
+	"github.com/sirupsen/logrus"
+)
+
+// budget of the namespaces without jq_timeout and of groups.jq/key.jq (0 no limit)
+var default_jq_timeout time.Duration
+
+func Set_default_jq_timeout(timeout time.Duration) {
+	default_jq_timeout = timeout
+}
+
+/*
+ * Jq_budget - time budget of each run of the jq programs of a namespace (filter, lambda, monitor, on_bucket_close)
+ *
+ *	after jq_quarantine_after runs over the budget the namespace is quarantined until it is reloaded:
+ *	its filter, lambda and monitors no longer run
+ */
+type Jq_budget struct {
+	namespace        string
+	timeout          time.Duration
+	quarantine_after int64
+	timeouts         atomic.Int64
+	quarantined      atomic.Bool
+}
+
+func new_jq_budget(namespace string, timeout time.Duration, quarantine_after int64) *Jq_budget {
+	return &Jq_budget{
+		namespace:        namespace,
+		timeout:          timeout,
+		quarantine_after: quarantine_after,
+	}
+}
+
+// context of one run, the caller must cancel it
+func (budget *Jq_budget) context() (context.Context, context.CancelFunc) {
+	timeout := default_jq_timeout
+	if budget != nil {
+		timeout = budget.timeout
+	}
+	if timeout <= 0 {
+		return context.Background(), func() {}
+	}
+	return context.WithTimeout(context.Background(), timeout)
+}
+
+// true if err is the end of the budget of program, counts it and quarantines the namespace if repeated
+func (budget *Jq_budget) exceeded(program string, err error) bool {
+	if !errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	namespace := ""
+	if budget != nil {
+		namespace = budget.namespace
+	}
+	logrus.Errorf("jq %s %s: exceeded its time budget", namespace, program)
+	prom_metrics.Prom_metric.Inc_jq_timeouts(namespace, program)
+
+	if budget != nil && budget.quarantine_after > 0 &&
+		budget.timeouts.Add(1) >= budget.quarantine_after && budget.quarantined.CompareAndSwap(false, true) {
+		logrus.Errorf("jq %s: quarantined after %d runs over its time budget, reload it to release", namespace, budget.quarantine_after)
+		prom_metrics.Prom_metric.Set_quarantined(namespace, true)
+	}
+	return true
+}
+
+func (budget *Jq_budget) Quarantined() bool {
+	return budget != nil && budget.quarantined.Load()
+}
@@ -0,0 +1,69 @@
+package flow
+
+import (
+	"encoding/json"
+	"time"
+
+	"example.com/streaming-metrics/src/prom_metrics"
+
+	"github.com/sirupsen/logrus"
+)
+
+/*
+ * Late_metrics - metrics dropped because they arrived later than the namespace allowed_lateness
+ * (reason late) or than the window of their id (reason expired)
+ *
+ *	A nil *Late_metrics only counts.
+ */
+
+type Late_metrics struct {
+	sink Sink
+}
+
+type Late_metric struct {
+	Reason     string    `json:"reason"`
+	Namespace  string    `json:"namespace"`
+	Id         string    `json:"id"`
+	Time       time.Time `json:"time"`
+	Store_time int64     `json:"store_time"`
+	Lateness   int64     `json:"lateness"`
+	Time_unit  string    `json:"time_unit"`
+	Metric     any       `json:"metric"`
+}
+
+// sink nil only counts the late metrics
+func New_late_metrics(sink Sink) *Late_metrics {
+	return &Late_metrics{
+		sink: sink,
+	}
+}
+
+func (late_metrics *Late_metrics) Send(late *Late_metric) {
+	prom_metrics.Prom_metric.Inc_late_metrics(late.Namespace, late.Reason)
+
+	if late_metrics == nil || late_metrics.sink == nil {
+		return
+	}
+
+	payload, err := json.Marshal(late)
+	if err != nil {
+		logrus.Errorf("Late_metrics marshal %s: %+v", late.Namespace, err)
+		return
+	}
+
+	late_metrics.sink.Send(late.Namespace, payload, func(err error) {
+		if err != nil {
+			logrus.Errorf("Late_metrics send %s: %+v", late.Namespace, err)
+		}
+	})
+}
+
+func (late_metrics *Late_metrics) Close() {
+	if late_metrics == nil || late_metrics.sink == nil {
+		return
+	}
+	if err := late_metrics.sink.Flush(); err != nil {
+		logrus.Errorf("Late_metrics flush: %+v", err)
+	}
+	late_metrics.sink.Close()
+}
@@ -0,0 +1,164 @@
+package flow
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+/*
+ * Time of a metric (the time argument of log) according to the namespace time_format:
+ *
+ *	"" (auto) - RFC3339 (any precision) strings, epoch numbers (s, ms, us or ns by magnitude)
+ *	s - ms - us - ns - epoch numbers (or numeric strings) in that unit
+ *	rfc3339 - rfc3339nano - or any Go layout (2006-01-02 15:04:05) for strings
+ *
+ *	missing (null) times use time_fallback: none (dropped) - publish_time - event_time (publish time if not set)
+ */
+
+var epoch_units = map[string]time.Duration{
+	"s":  time.Second,
+	"ms": time.Millisecond,
+	"us": time.Microsecond,
+	"ns": time.Nanosecond,
+}
+
+func valid_time_fallback(fallback string) bool {
+	switch fallback {
+	case "", "none", "publish_time", "event_time":
+		return true
+	default:
+		return false
+	}
+}
+
+// errors are parse failures, missing is true when there is no time and no fallback
+func (namespace *Namespace) metric_time(metric *Metric) (t time.Time, missing bool, err error) {
+	if metric.time == nil {
+		switch namespace.Time_fallback {
+		case "publish_time":
+			return metric.publish_time, false, nil
+		case "event_time":
+			if metric.event_time.IsZero() {
+				return metric.publish_time, false, nil
+			}
+			return metric.event_time, false, nil
+		default:
+			return time.Time{}, true, nil
+		}
+	}
+
+	t, err = parse_time(metric.time, namespace.Time_format)
+	return t, false, err
+}
+
+func parse_time(v any, time_format string) (time.Time, error) {
+	unit, is_unit := epoch_units[time_format]
+
+	switch tv := v.(type) {
+	case string:
+		if is_unit {
+			if n, err := strconv.ParseInt(tv, 10, 64); err == nil {
+				return from_epoch_int(n, unit)
+			}
+			n, err := strconv.ParseFloat(tv, 64)
+			if err != nil {
+				return time.Time{}, fmt.Errorf("parse_time %q is not a number of %s", tv, time_format)
+			}
+			return from_epoch(n, unit)
+		}
+		switch time_format {
+		case "", "rfc3339", "rfc3339nano":
+			// RFC3339 parsing accepts any fraction of second
+			return time.Parse(time.RFC3339Nano, tv)
+		default:
+			return time.Parse(time_format, tv)
+		}
+
+	case float64:
+		unit, err := epoch_unit(tv, time_format, unit, is_unit)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return from_epoch(tv, unit)
+	// integers stay exact (a float64 loses the nanoseconds of current epoch times)
+	case int:
+		return parse_epoch_int(int64(tv), time_format, unit, is_unit)
+	case int64:
+		return parse_epoch_int(tv, time_format, unit, is_unit)
+	case json.Number:
+		if n, err := tv.Int64(); err == nil {
+			return parse_epoch_int(n, time_format, unit, is_unit)
+		}
+		f, err := tv.Float64()
+		if err != nil {
+			return time.Time{}, fmt.Errorf("parse_time %v is not a number", tv)
+		}
+		return parse_time(f, time_format)
+
+	default:
+		return time.Time{}, fmt.Errorf("parse_time %+v is not a string or a number", v)
+	}
+}
+
+func parse_epoch_int(n int64, time_format string, unit time.Duration, is_unit bool) (time.Time, error) {
+	unit, err := epoch_unit(float64(n), time_format, unit, is_unit)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return from_epoch_int(n, unit)
+}
+
+// unit of the epoch number n: the time_format unit, or by magnitude (auto)
+func epoch_unit(n float64, time_format string, unit time.Duration, is_unit bool) (time.Duration, error) {
+	if is_unit {
+		return unit, nil
+	}
+	if time_format != "" {
+		return 0, fmt.Errorf("parse_time %v is a number, time_format %s expects a string", n, time_format)
+	}
+
+	abs := math.Abs(n)
+	switch {
+	case abs < 1e11:
+		return time.Second, nil
+	case abs < 1e14:
+		return time.Millisecond, nil
+	case abs < 1e17:
+		return time.Microsecond, nil
+	default:
+		return time.Nanosecond, nil
+	}
+}
+
+func from_epoch(n float64, unit time.Duration) (time.Time, error) {
+	whole, frac := math.Modf(n)
+	// -2^63 <= whole < 2^63, else the int64 conversion is undefined
+	if math.IsNaN(whole) || whole < math.MinInt64 || whole >= math.MaxInt64 {
+		return time.Time{}, fmt.Errorf("parse_time %v %s is out of range", n, unit_name(unit))
+	}
+	t, err := from_epoch_int(int64(whole), unit)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return t.Add(time.Duration(frac * float64(unit))), nil
+}
+
+// times are int64 nanoseconds since the epoch (years 1678 to 2262)
+func from_epoch_int(n int64, unit time.Duration) (time.Time, error) {
+	if n > math.MaxInt64/int64(unit) || n < math.MinInt64/int64(unit) {
+		return time.Time{}, fmt.Errorf("parse_time %d %s is out of range", n, unit_name(unit))
+	}
+	return time.Unix(0, n*int64(unit)), nil
+}
+
+func unit_name(unit time.Duration) string {
+	for name, u := range epoch_units {
+		if u == unit {
+			return name
+		}
+	}
+	return unit.String()
+}
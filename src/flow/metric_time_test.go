@@ -0,0 +1,76 @@
+package flow
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestParse_time(t *testing.T) {
+	cases := []struct {
+		v           any
+		time_format string
+		expected    time.Time
+		valid       bool
+	}{
+		// auto unit by magnitude, integers exact
+		{int(1704067200), "", time.Unix(1704067200, 0), true},
+		{int64(1704067200123), "", time.Unix(0, 1704067200123*int64(time.Millisecond)), true},
+		{int64(1704067200123456), "", time.Unix(0, 1704067200123456*int64(time.Microsecond)), true},
+		{int64(1704067200123456789), "", time.Unix(0, 1704067200123456789), true},
+		{json.Number("1704067200123456789"), "", time.Unix(0, 1704067200123456789), true},
+		{json.Number("1704067200.5"), "", time.Unix(1704067200, 5e8), true},
+		{float64(1704067200.25), "", time.Unix(1704067200, 25e7), true},
+		{float64(1704067200123), "", time.Unix(0, 1704067200123*int64(time.Millisecond)), true},
+		{"2024-01-01T00:00:00.123456789Z", "", time.Unix(1704067200, 123456789), true},
+		{"2024-01-01T01:00:00+01:00", "rfc3339", time.Unix(1704067200, 0), true},
+
+		// explicit unit, numbers or numeric strings
+		{int(1500), "ms", time.Unix(1, 5e8), true},
+		{int64(1704067200), "ns", time.Unix(0, 1704067200), true},
+		{json.Number("1704067200123456789"), "ns", time.Unix(0, 1704067200123456789), true},
+		{"1704067200", "s", time.Unix(1704067200, 0), true},
+		{"1704067200123456789", "ns", time.Unix(0, 1704067200123456789), true},
+		{"1704067200.25", "s", time.Unix(1704067200, 25e7), true},
+
+		// go layout
+		{"2024-01-01 00:00:00", "2006-01-02 15:04:05", time.Unix(1704067200, 0), true},
+
+		{"abc", "ms", time.Time{}, false},
+		{"2024-01-01", "", time.Time{}, false},
+		{int(5), "rfc3339", time.Time{}, false},
+		{json.Number("1e400"), "", time.Time{}, false},
+		// beyond int64 nanoseconds (year 2262)
+		{int64(9223372036), "s", time.Unix(9223372036, 0), true},
+		{int64(9223372037), "s", time.Time{}, false},
+		{int64(-9223372037), "s", time.Time{}, false},
+		{int64(10000000000), "s", time.Time{}, false},
+		{json.Number("10000000000000000"), "ms", time.Time{}, false},
+		{"10000000000", "s", time.Time{}, false},
+		{"1e30", "s", time.Time{}, false},
+		{float64(1e10), "s", time.Time{}, false},
+		{float64(1e19), "", time.Time{}, false},
+		{math.NaN(), "s", time.Time{}, false},
+		{math.Inf(1), "", time.Time{}, false},
+		{true, "", time.Time{}, false},
+		{map[string]any{}, "", time.Time{}, false},
+	}
+
+	for _, c := range cases {
+		parsed, err := parse_time(c.v, c.time_format)
+		if !c.valid {
+			if err == nil {
+				t.Errorf("parse_time(%#v, %q) = %v, expected an error", c.v, c.time_format, parsed)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parse_time(%#v, %q): %v", c.v, c.time_format, err)
+			continue
+		}
+		if !parsed.Equal(c.expected) {
+			t.Errorf("parse_time(%#v, %q) = %v, expected %v", c.v, c.time_format, parsed.UTC(), c.expected.UTC())
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package flow
+
+import (
+	"fmt"
+
+	"github.com/itchyny/gojq"
+
+	"example.com/streaming-metrics/src/store/memory_store"
+)
+
+/*
+ * Migration of the persisted windows when granularity or cardinality change (cached_pebble_store)
+ *
+ *	migration: resample (default) - reset (drop the history)
+ *	migration_merge: jq (builtins only) from the array of the old states falling in one new bucket
+ *		to its state ("add"), without it the most recent state is kept
+ */
+func (namespace *Namespace) migration() (*memory_store.Migration, error) {
+	switch namespace.Migration {
+	case "", "resample":
+	case "reset":
+		return &memory_store.Migration{Reset: true}, nil
+	default:
+		return nil, fmt.Errorf("%s is not a valid migration (resample - reset)", namespace.Migration)
+	}
+
+	if namespace.Migration_merge == "" {
+		return &memory_store.Migration{}, nil
+	}
+
+	query, err := gojq.Parse(namespace.Migration_merge)
+	if err != nil {
+		return nil, fmt.Errorf("migration_merge: %w", err)
+	}
+	code, err := gojq.Compile(query)
+	if err != nil {
+		return nil, fmt.Errorf("migration_merge: %w", err)
+	}
+
+	return &memory_store.Migration{
+		Merge: func(states []any) (any, error) {
+			ctx, cancel := namespace.budget.context()
+			defer cancel()
+
+			v, ok := code.RunWithContext(ctx, states).Next()
+			if !ok {
+				return nil, fmt.Errorf("migration_merge returned nothing")
+			}
+			if err, ok := v.(error); ok {
+				namespace.budget.exceeded("migration_merge", err)
+				return nil, err
+			}
+			return v, nil
+		},
+	}, nil
+}
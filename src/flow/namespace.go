@@ -1,6 +1,8 @@
 package flow
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"time"
 
@@ -8,6 +10,7 @@ import (
 	"github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v3"
 
+	"example.com/streaming-metrics/src/prom_metrics"
 	"example.com/streaming-metrics/src/store"
 	"example.com/streaming-metrics/src/store/memory_store"
 )
@@ -15,8 +18,12 @@ import (
 type Metric struct {
 	namespace string
 	id        string
-	time      string
+	time      any
 	metric    any
+	topic     string
+
+	publish_time time.Time
+	event_time   time.Time
 }
 
 type Namespace struct {
@@ -27,11 +34,57 @@ type Namespace struct {
 	Snapshot    int64  `json:"snapshot" yaml:"snapshot"`
 	Current     bool   `json:"current" yaml:"current"`
 	Store_type  string `json:"store_type" yaml:"store_type"`
+	Time_unit   string `json:"time_unit" yaml:"time_unit"`
+	// cached_pebble_store: every write is synced before the metric is acked (slower, nothing lost on a crash)
+	Synced_writes bool `json:"synced_writes" yaml:"synced_writes"`
+	// cached_pebble_store: encoding of the persisted states, cbor - json (empty keeps the persisted one, cbor for a new namespace)
+	State_codec string `json:"state_codec" yaml:"state_codec"`
+	// of the persisted windows on a granularity/cardinality change, see migration()
+	Migration       string `json:"migration" yaml:"migration"`
+	Migration_merge string `json:"migration_merge" yaml:"migration_merge"`
+	// event - processing - ingestion, see time_mode()
+	Time_mode string `json:"time_mode" yaml:"time_mode"`
+	// runs monitor.jq when the bucket group of the store moves instead of every granularity*snapshot
+	Monitor_on_bucket_close bool `json:"monitor_on_bucket_close" yaml:"monitor_on_bucket_close"`
+	// interval (default) - aligned - cron expression, see monitor_schedule()
+	Schedule string `json:"schedule" yaml:"schedule"`
+	// durations ("30s"), the offset shifts aligned/cron runs, the jitter randomly delays every run
+	Schedule_offset string `json:"schedule_offset" yaml:"schedule_offset"`
+	Schedule_jitter string `json:"schedule_jitter" yaml:"schedule_jitter"`
+	// queue (default) - skip - coalesce, when a run is still queued or running
+	Overlap_policy string `json:"overlap_policy" yaml:"overlap_policy"`
+
+	// duration ("200ms") of each jq run, empty uses the jq_timeout_ms flag, see Jq_budget
+	Jq_timeout string `json:"jq_timeout" yaml:"jq_timeout"`
+	// runs over jq_timeout before the namespace is quarantined (0 never)
+	Jq_quarantine_after int64 `json:"jq_quarantine_after" yaml:"jq_quarantine_after"`
+
+	// in time_unit behind the store time, nil only drops what is older than the window
+	Allowed_lateness *int64 `json:"allowed_lateness" yaml:"allowed_lateness"`
+	// in time_unit ahead of the message publish time, nil accepts any future time
+	Max_future_skew *int64 `json:"max_future_skew" yaml:"max_future_skew"`
+	// reject (default) - clamp (to the publish time)
+	Future_policy string `json:"future_policy" yaml:"future_policy"`
+
+	Time_format   string `json:"time_format" yaml:"time_format"`
+	Time_fallback string `json:"time_fallback" yaml:"time_fallback"`
 
 	store store.Store
+	// reload: namespace whose store is handed over to this one (see Take_over_stores)
+	replaces *Namespace
+	// replay/test: the processing time is the simulated (publish) time
+	offline bool
+	// closed bucket group of the store at the last tick, set once initialized (see init_bucket_group)
+	last_bucket_group int64
+	initialized       bool
+	// event time_mode: watermark of the metric times, the store clock
+	event_watermark *Watermark
 
-	lambda  *gojq.Code
-	monitor *gojq.Code
+	lambda          *gojq.Code
+	monitor         *gojq.Code
+	on_bucket_close *gojq.Code
+
+	budget *Jq_budget
 }
 
 /*
@@ -39,6 +92,136 @@ type Namespace struct {
  */
 
 func New_namesapce(buf []byte) *Namespace {
+	namespace := parse_namespace(buf)
+	if namespace == nil {
+		return nil
+	}
+
+	if err := namespace.create_store(); err != nil {
+		logrus.Errorf("New_namespace: %+v", err)
+		return nil
+	}
+
+	return namespace
+}
+
+/*
+ * Namespace with a fresh memory_store whatever the configured store_type (used by replay/test)
+ */
+func New_offline_namespace(buf []byte) *Namespace {
+	namespace := parse_namespace(buf)
+	if namespace == nil {
+		return nil
+	}
+
+	namespace.Store_type = "memory_store"
+	namespace.offline = true
+	if err := namespace.create_store(); err != nil {
+		logrus.Errorf("New_offline_namespace: %+v", err)
+		return nil
+	}
+
+	return namespace
+}
+
+/*
+ * Namespace for a reload, keeps the store of the previous namespace with the same name if compatible,
+ * otherwise its store is created by Pipeline.Take_over_stores from the state of the previous one
+ */
+func Reload_namespace(buf []byte, previous map[string]*Namespace) *Namespace {
+	namespace := parse_namespace(buf)
+	if namespace == nil {
+		return nil
+	}
+
+	// a reload releases the quarantine
+	if old, ok := previous[namespace.Namespace]; ok && old.budget.Quarantined() {
+		prom_metrics.Prom_metric.Set_quarantined(namespace.Namespace, false)
+	}
+
+	if old, ok := previous[namespace.Namespace]; ok {
+		namespace.event_watermark = old.event_watermark
+		if namespace.same_store(old) {
+			namespace.store = old.store
+			namespace.init_bucket_group()
+		} else {
+			namespace.replaces = old
+		}
+		return namespace
+	}
+
+	if err := namespace.create_store(); err != nil {
+		logrus.Errorf("Reload_namespace: %+v", err)
+		return nil
+	}
+
+	return namespace
+}
+
+// state of the store of old, unless the new store loaded it (pebble) or the migration resets it
+func (namespace *Namespace) import_snapshot(old *Namespace, snapshot *store.Snapshot) {
+	// the new store loaded (and migrated) the keys the stopped store wrote
+	if namespace.Store_type == "cached_pebble_store" && old.Store_type == "cached_pebble_store" {
+		return
+	}
+	migration, _ := namespace.migration()
+	resized := namespace.Granularity != old.Granularity || namespace.Cardinality != old.Cardinality || namespace.time_unit() != old.time_unit()
+	if resized && migration != nil && migration.Reset {
+		logrus.Infof("take_over %s: migration reset, the previous windows are dropped", namespace.Namespace)
+		return
+	}
+	if err := namespace.store.Import(snapshot); err != nil {
+		logrus.Errorf("take_over %s: %+v, the previous windows are dropped", namespace.Namespace, err)
+	}
+}
+
+func (namespace *Namespace) same_store(other *Namespace) bool {
+	return namespace.Store_type == other.Store_type &&
+		namespace.Granularity == other.Granularity &&
+		namespace.Cardinality == other.Cardinality &&
+		namespace.Current == other.Current &&
+		namespace.unit() == other.unit() &&
+		namespace.Synced_writes == other.Synced_writes &&
+		namespace.same_state_codec(other)
+}
+
+// empty keeps the codec of the persisted data: only another explicit codec than the one of the store needs a new store
+func (namespace *Namespace) same_state_codec(other *Namespace) bool {
+	if namespace.Store_type != "cached_pebble_store" || namespace.State_codec == "" {
+		return true
+	}
+	if codec, ok := other.store.(interface{ State_codec() string }); ok {
+		return codec.State_codec() == namespace.State_codec
+	}
+	return namespace.State_codec == other.State_codec
+}
+
+/*
+ * Creates the store from the state of the store of replaces: the previous store stops once the calls in progress
+ * finish and forwards the later ones, so nothing pushed before the pipeline swap is lost
+ */
+func (namespace *Namespace) take_over() error {
+	old := namespace.replaces
+	var err error
+
+	handed := old.store.Hand_over(func(snapshot *store.Snapshot) store.Store {
+		if err = namespace.create_store(); err != nil {
+			return nil
+		}
+		namespace.store.Set_track_closed_buckets(namespace.on_bucket_close != nil, namespace.Allowed_lateness)
+		namespace.import_snapshot(old, snapshot)
+		namespace.init_bucket_group()
+		return namespace.store
+	})
+	if handed == nil {
+		return fmt.Errorf("take_over %s: %w", namespace.Namespace, err)
+	}
+
+	namespace.replaces = nil
+	return nil
+}
+
+func parse_namespace(buf []byte) *Namespace {
 	var namespace Namespace
 
 	if err := yaml.Unmarshal(buf, &namespace); err != nil {
@@ -51,26 +234,113 @@ func New_namesapce(buf []byte) *Namespace {
 		return nil
 	}
 
-	if err := namespace.create_store(); err != nil {
-		logrus.Errorf("New_namespace: %+v", err)
-		return nil
+	timeout := default_jq_timeout
+	if namespace.Jq_timeout != "" {
+		timeout, _ = time.ParseDuration(namespace.Jq_timeout)
 	}
+	namespace.budget = new_jq_budget(namespace.Namespace, timeout, namespace.Jq_quarantine_after)
+	namespace.event_watermark = New_watermark(0)
 
 	return &namespace
 }
 
+/*
+ * Checks a config without creating its store, returns the namespace (nil if unreadable) and the problems found
+ */
+func Check_namespace_config(buf []byte) (*Namespace, []string) {
+	var namespace Namespace
+	problems := make([]string, 0)
+
+	if err := yaml.Unmarshal(buf, &namespace); err != nil {
+		return nil, append(problems, err.Error())
+	}
+
+	var known Namespace
+	decoder := yaml.NewDecoder(bytes.NewReader(buf))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&known); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	if len(namespace.Namespace) == 0 {
+		problems = append(problems, "namespace is empty")
+	}
+	if namespace.Granularity <= 0 {
+		problems = append(problems, "granularity must be > 0")
+	}
+	if namespace.Cardinality <= 0 {
+		problems = append(problems, "cardinality must be > 0")
+	}
+	if namespace.Snapshot <= 0 {
+		problems = append(problems, "snapshot must be > 0")
+	}
+	if namespace.Allowed_lateness != nil && *namespace.Allowed_lateness < 0 {
+		problems = append(problems, "allowed_lateness must be >= 0")
+	}
+	if namespace.Max_future_skew != nil && *namespace.Max_future_skew < 0 {
+		problems = append(problems, "max_future_skew must be >= 0")
+	}
+	if !valid_future_policy(namespace.Future_policy) {
+		problems = append(problems, fmt.Sprintf("%s is not a valid future_policy (reject - clamp)", namespace.Future_policy))
+	}
+	if !valid_store_type(namespace.Store_type) {
+		problems = append(problems, fmt.Sprintf("%s is not a valid store_type", namespace.Store_type))
+	}
+	if !valid_time_unit(namespace.Time_unit) {
+		problems = append(problems, fmt.Sprintf("%s is not a valid time_unit (s - ms - us)", namespace.Time_unit))
+	}
+	if !valid_time_mode(namespace.Time_mode) {
+		problems = append(problems, fmt.Sprintf("%s is not a valid time_mode (event - processing - ingestion)", namespace.Time_mode))
+	}
+	if !valid_time_fallback(namespace.Time_fallback) {
+		problems = append(problems, fmt.Sprintf("%s is not a valid time_fallback (none - publish_time - event_time)", namespace.Time_fallback))
+	}
+	if !memory_store.Valid_state_codec(namespace.State_codec) {
+		problems = append(problems, fmt.Sprintf("%s is not a valid state_codec (cbor - json)", namespace.State_codec))
+	}
+	if !memory_store.Valid_synced_writes(namespace.Synced_writes) {
+		problems = append(problems, "synced_writes needs the pebble write-ahead log (-pebble_disable_wal is set)")
+	}
+	problems = append(problems, namespace.check_schedule()...)
+	if _, err := parse_optional_duration(namespace.Jq_timeout); err != nil {
+		problems = append(problems, fmt.Sprintf("jq_timeout: %v", err))
+	}
+	if namespace.Jq_quarantine_after < 0 {
+		problems = append(problems, "jq_quarantine_after must be >= 0")
+	}
+	if _, err := namespace.migration(); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	return &namespace, problems
+}
+
+func valid_store_type(store_type string) bool {
+	switch store_type {
+	case "memory_store", "cached_pebble_store":
+		return true
+	default:
+		return false
+	}
+}
+
 func (namespace *Namespace) create_store() error {
 	switch namespace.Store_type {
 	case "memory_store":
-		namespace.store = memory_store.New_memory_store(namespace.Namespace, namespace.Granularity, namespace.Cardinality, namespace.Snapshot, namespace.Current)
+		namespace.store = memory_store.New_memory_store(namespace.Namespace, namespace.Granularity, namespace.Cardinality, namespace.Snapshot, namespace.Current, namespace.time_unit())
 	case "cached_pebble_store":
-		namespace.store = memory_store.New_cached_persistent_store(namespace.Namespace, namespace.Granularity, namespace.Cardinality, namespace.Snapshot, namespace.Current)
+		migration, err := namespace.migration()
+		if err != nil {
+			return fmt.Errorf("namespace.create_store %s: %w", namespace.Namespace, err)
+		}
+		namespace.store = memory_store.New_cached_persistent_store(namespace.Namespace, namespace.Granularity, namespace.Cardinality, namespace.Snapshot, namespace.Current, namespace.time_unit(), namespace.Synced_writes, migration, namespace.State_codec)
 	default:
 		return fmt.Errorf("namespace.create_store %s: %s is not a valid store_type", namespace.Namespace, namespace.Store_type)
 	}
 	if namespace.store == nil {
 		return fmt.Errorf("namespace.create_store %s: unable to create %s", namespace.Namespace, namespace.Store_type)
 	}
+	namespace.init_bucket_group()
 
 	return nil
 }
@@ -83,24 +353,317 @@ func (namespace *Namespace) Set_monitor(monitor *gojq.Code) {
 	namespace.monitor = monitor
 }
 
-func (namespace *Namespace) push(metric *Metric) {
-	if metric.namespace != namespace.Namespace {
-		return
+// optional (nil), run for every closed bucket with a state
+func (namespace *Namespace) Set_on_bucket_close(on_bucket_close *gojq.Code) {
+	namespace.on_bucket_close = on_bucket_close
+	// without store until Take_over_stores
+	if namespace.store != nil {
+		namespace.store.Set_track_closed_buckets(on_bucket_close != nil, namespace.Allowed_lateness)
+	}
+}
+
+// full state of the store (export command, admin endpoint)
+func (namespace *Namespace) Export_snapshot() *store.Snapshot {
+	return namespace.store.Export()
+}
+
+// replaces the state of the store, resampled if the granularity or time_unit of snapshot differs
+func (namespace *Namespace) Import_snapshot(snapshot *store.Snapshot) error {
+	if snapshot.Namespace != namespace.Namespace {
+		logrus.Warnf("Import_snapshot %s: snapshot of namespace %s", namespace.Namespace, snapshot.Namespace)
+	}
+	return namespace.store.Import(snapshot)
+}
+
+func (namespace *Namespace) Budget() *Jq_budget {
+	return namespace.budget
+}
+
+// returns the metric if it was dropped for being late
+func (namespace *Namespace) push(metric *Metric) *Late_metric {
+	if metric.namespace != namespace.Namespace || namespace.budget.Quarantined() {
+		return nil
+	}
+	ti, missing, err := namespace.push_time(metric)
+	if missing {
+		logrus.Warnf("namespace.push %s: metric without time (no time_fallback)", namespace.Namespace)
+		prom_metrics.Prom_metric.Inc_time_parse_failures(namespace.Namespace, "missing")
+		return nil
 	}
-	ti, err := time.Parse(time.RFC3339, metric.time)
 	if err != nil {
 		logrus.Warnf("namespace.push %s: %+v", namespace.Namespace, err)
-		return
+		prom_metrics.Prom_metric.Inc_time_parse_failures(namespace.Namespace, "invalid")
+		return nil
+	}
+
+	t := namespace.store_time(ti)
+	if namespace.Max_future_skew != nil {
+		var ok bool
+		if ti, t, ok = namespace.check_future(metric, ti, t); !ok {
+			return nil
+		}
+	}
+
+	if namespace.Time_mode == "event" {
+		namespace.event_watermark.Observe(metric.topic, ti)
+	}
+
+	current_time := namespace.store.Current_time()
+	if namespace.Allowed_lateness != nil && t < current_time-*namespace.Allowed_lateness {
+		return namespace.late_metric("late", metric, ti, t, current_time)
+	}
+	ctx, cancel := namespace.budget.context()
+	defer cancel()
+	pushed := namespace.store.Push(ctx, metric.id, t, metric.metric, namespace.lambda)
+	namespace.budget.exceeded("lambda", ctx.Err())
+	if !pushed {
+		return namespace.late_metric("expired", metric, ti, t, current_time)
+	}
+	return nil
+}
+
+/*
+ * Metrics more than max_future_skew ahead of their message publish time (wall clock if unknown)
+ * are rejected or clamped to it, so a skewed producer clock can not move the windows forward
+ */
+func (namespace *Namespace) check_future(metric *Metric, ti time.Time, t int64) (time.Time, int64, bool) {
+	reference := metric.publish_time
+	if reference.IsZero() {
+		reference = time.Now()
+	}
+	reference_t := namespace.store_time(reference)
+
+	if t-reference_t <= *namespace.Max_future_skew {
+		return ti, t, true
+	}
+
+	if namespace.Future_policy == "clamp" {
+		logrus.Debugf("namespace.push %s: %s time %v clamped to %v", namespace.Namespace, metric.id, ti, reference)
+		prom_metrics.Prom_metric.Inc_future_metrics(namespace.Namespace, "clamp")
+		return reference, reference_t, true
+	}
+
+	logrus.Debugf("namespace.push %s: %s time %v rejected, ahead of %v", namespace.Namespace, metric.id, ti, reference)
+	prom_metrics.Prom_metric.Inc_future_metrics(namespace.Namespace, "reject")
+	return ti, t, false
+}
+
+func valid_future_policy(policy string) bool {
+	return policy == "" || policy == "reject" || policy == "clamp"
+}
+
+func (namespace *Namespace) late_metric(reason string, metric *Metric, ti time.Time, t int64, current_time int64) *Late_metric {
+	return &Late_metric{
+		Reason:     reason,
+		Namespace:  namespace.Namespace,
+		Id:         metric.id,
+		Time:       ti,
+		Store_time: current_time,
+		Lateness:   current_time - t,
+		Time_unit:  namespace.time_unit(),
+		Metric:     metric.metric,
 	}
-	namespace.store.Push(metric.id, ti.Unix(), metric.metric, namespace.lambda)
 }
 
-func (namespace *Namespace) tick(t time.Time) {
-	namespace.store.Tick(t.Unix())
+/*
+ * time_mode - which time the metrics are pushed with, what clock advances the store and runs the monitor
+ *
+ *	event - metric time, watermark of the metric times, its crossing granularity*snapshot boundaries
+ *	ingestion - message publish time, watermark, watermark crossing boundaries
+ *	processing - wall clock, wall clock, wall clock ticker
+ *	"" - metric time, watermark, wall clock ticker (the behaviour before time_mode)
+ */
+
+func valid_time_mode(time_mode string) bool {
+	switch time_mode {
+	case "", "event", "processing", "ingestion":
+		return true
+	default:
+		return false
+	}
+}
+
+func (namespace *Namespace) push_time(metric *Metric) (time.Time, bool, error) {
+	switch namespace.Time_mode {
+	case "processing":
+		if namespace.offline {
+			return metric.publish_time, false, nil
+		}
+		return time.Now(), false, nil
+	case "ingestion":
+		return metric.publish_time, false, nil
+	default:
+		return namespace.metric_time(metric)
+	}
+}
+
+// time the store is ticked to, zero until a message is read (the publish time watermark is zero)
+func (namespace *Namespace) clock(watermark time.Time, now time.Time, idle_timeout time.Duration) time.Time {
+	switch namespace.Time_mode {
+	case "processing":
+		return now
+	case "event":
+		t, _, _ := namespace.event_watermark.advance(now, idle_timeout)
+		return t
+	default:
+		return watermark
+	}
+}
+
+/*
+ * What runs the monitor:
+ *	bucket_close - the bucket group of the store moves (monitor_on_bucket_close)
+ *	wall_clock - a ticker every granularity*snapshot
+ *	watermark - the watermark crosses a granularity*snapshot boundary
+ */
+func (namespace *Namespace) monitor_trigger() string {
+	switch {
+	case namespace.Monitor_on_bucket_close:
+		return "bucket_close"
+	case namespace.Time_mode == "" || namespace.Time_mode == "processing":
+		return "wall_clock"
+	default:
+		return "watermark"
+	}
+}
+
+func (namespace *Namespace) bucket_close_trigger() bool {
+	return namespace.Monitor_on_bucket_close || namespace.on_bucket_close != nil
+}
+
+// returns true if the buckets closed moved (the bucket group of the store time minus allowed_lateness)
+func (namespace *Namespace) tick(t time.Time) bool {
+	namespace.store.Tick(namespace.store_time(t))
+
+	bucket_group := namespace.closed_bucket_group()
+	moved := namespace.initialized && bucket_group > namespace.last_bucket_group
+	if !namespace.initialized || bucket_group > namespace.last_bucket_group {
+		namespace.last_bucket_group = bucket_group
+		namespace.initialized = true
+	}
+	return moved
+}
+
+func (namespace *Namespace) closed_bucket_group() int64 {
+	current_time := namespace.store.Current_time()
+	if namespace.Allowed_lateness != nil {
+		current_time -= *namespace.Allowed_lateness
+	}
+	return current_time / namespace.Granularity
+}
+
+// the first tick compares with the store time the namespace started with, unless the store has no time yet
+func (namespace *Namespace) init_bucket_group() {
+	if namespace.store.Current_time() > 0 {
+		namespace.last_bucket_group = namespace.closed_bucket_group()
+		namespace.initialized = true
+	}
+}
+
+// runs the monitor and returns the marshaled outputs
+func (namespace *Namespace) run_monitor() [][]byte {
+	return namespace.run_program("monitor", namespace.monitor, namespace.gojq_namespace(), make([][]byte, 0))
+}
+
+/*
+ * runs on_bucket_close.jq for every bucket closed since the last call, then the monitor if monitor_on_bucket_close
+ *
+ *	on_bucket_close.jq input: {namespace, id, bucket_start, granularity, time_unit, state}
+ */
+func (namespace *Namespace) run_bucket_close() [][]byte {
+	outputs := make([][]byte, 0)
+
+	if namespace.on_bucket_close != nil {
+		for _, closed := range namespace.store.Closed_buckets() {
+			outputs = namespace.run_program("on_bucket_close", namespace.on_bucket_close, map[string]any{
+				"namespace":    namespace.Namespace,
+				"id":           closed.Id,
+				"bucket_start": closed.Bucket_start,
+				"granularity":  namespace.Granularity,
+				"time_unit":    namespace.time_unit(),
+				"state":        closed.State,
+			}, outputs)
+		}
+	}
+
+	if namespace.Monitor_on_bucket_close {
+		outputs = namespace.run_program("monitor", namespace.monitor, namespace.gojq_namespace(), outputs)
+	}
+
+	return outputs
+}
+
+func (namespace *Namespace) run_program(name string, program *gojq.Code, input any, outputs [][]byte) [][]byte {
+	if namespace.budget.Quarantined() {
+		return outputs
+	}
+
+	ctx, cancel := namespace.budget.context()
+	defer cancel()
+
+	iter := program.RunWithContext(ctx, input)
+	for {
+		v, ok := iter.Next()
+
+		if !ok {
+			break
+		}
+		if err, ok := v.(error); ok {
+			if namespace.budget.exceeded(name, err) {
+				break
+			}
+			logrus.Errorf("Alarm %s: %+v", namespace.Namespace, err)
+			continue
+		} else {
+			logrus.Debugf("%+v", v)
+			payload, err := json.Marshal(v)
+			if err != nil {
+				logrus.Errorf("Alarm marshal: %+v", err)
+				continue
+			}
+			outputs = append(outputs, payload)
+		}
+	}
+
+	return outputs
 }
 
 func (namespace *Namespace) interval() time.Duration {
-	return time.Duration(namespace.Granularity*namespace.Snapshot) * time.Second
+	return time.Duration(namespace.Granularity*namespace.Snapshot) * namespace.unit()
+}
+
+/*
+ * Time unit of granularity and of the store times: s (default) - ms - us
+ */
+
+var time_units = map[string]time.Duration{
+	"s":  time.Second,
+	"ms": time.Millisecond,
+	"us": time.Microsecond,
+}
+
+func valid_time_unit(time_unit string) bool {
+	_, ok := time_units[time_unit]
+	return ok || time_unit == ""
+}
+
+func (namespace *Namespace) time_unit() string {
+	if namespace.Time_unit == "" {
+		return "s"
+	}
+	return namespace.Time_unit
+}
+
+func (namespace *Namespace) unit() time.Duration {
+	return time_units[namespace.time_unit()]
+}
+
+// t in the namespace time unit since the unix epoch
+func (namespace *Namespace) store_time(t time.Time) int64 {
+	if namespace.unit() == time.Second {
+		return t.Unix()
+	}
+	return t.UnixNano() / int64(namespace.unit())
 }
 
 func (namespace *Namespace) gojq_namespace() map[string]any {
@@ -111,26 +674,33 @@ func (namespace *Namespace) gojq_namespace() map[string]any {
 		"cardinality": namespace.Cardinality,
 		"snapshot":    namespace.Snapshot,
 		"current":     namespace.Current,
+		"time_unit":   namespace.time_unit(),
 		"windows":     store_rep,
 		"time":        current_time,
 	}
 }
 
 func (namespace *Namespace) valid_config() bool {
-	return len(namespace.Namespace) > 0 && namespace.Granularity > 0 && namespace.Cardinality > 0 && namespace.Snapshot > 0
+	return len(namespace.Namespace) > 0 && namespace.Granularity > 0 && namespace.Cardinality > 0 && namespace.Snapshot > 0 &&
+		valid_time_unit(namespace.Time_unit) && valid_time_fallback(namespace.Time_fallback) && valid_future_policy(namespace.Future_policy) &&
+		valid_time_mode(namespace.Time_mode) && len(namespace.check_schedule()) == 0 &&
+		valid_optional_duration(namespace.Jq_timeout) && namespace.Jq_quarantine_after >= 0 &&
+		memory_store.Valid_state_codec(namespace.State_codec) && memory_store.Valid_synced_writes(namespace.Synced_writes) &&
+		(namespace.Allowed_lateness == nil || *namespace.Allowed_lateness >= 0) &&
+		(namespace.Max_future_skew == nil || *namespace.Max_future_skew >= 0)
 }
 
-func metric_from_any(in any) *Metric {
+func metric_from_any(in any) (*Metric, error) {
 	switch v := in.(type) {
 	case map[string]any:
 		namespace, ok_namespace := v["namespace"].(string)
 		id, ok_id := v["id"].(string)
-		time, ok_time := v["time"].(string)
+		// a null time uses the namespace time_fallback
+		time := v["time"]
 		metric, ok_metric := v["metric"]
 
-		if !ok_namespace || !ok_id || !ok_time || !ok_metric {
-			logrus.Errorf("metric_from_any missing field from in map filter - status: namespace(%t) id(%t) time(%t) metric(%t)", ok_namespace, ok_id, ok_time, ok_metric)
-			return nil
+		if !ok_namespace || !ok_id || !ok_metric {
+			return nil, fmt.Errorf("metric_from_any missing field from in map filter - status: namespace(%t) id(%t) metric(%t)", ok_namespace, ok_id, ok_metric)
 		}
 
 		return &Metric{
@@ -138,10 +708,9 @@ func metric_from_any(in any) *Metric {
 			id:        id,
 			time:      time,
 			metric:    metric,
-		}
+		}, nil
 	default:
-		logrus.Errorf("metric_from_any filter did not return a map: %+v", in)
-		return nil
+		return nil, fmt.Errorf("metric_from_any filter did not return a map: %+v", in)
 	}
 
 }
@@ -0,0 +1,60 @@
+package flow
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+/*
+ * Pipeline - namespaces and filters in use, replaced as a whole on reload
+ * (shared as an atomic.Pointer[Pipeline], never modified after being published)
+ */
+
+type Pipeline struct {
+	Namespaces map[string]*Namespace
+	Filters    *Filter_root
+}
+
+func New_pipeline(namespaces map[string]*Namespace, filters *Filter_root) *Pipeline {
+	return &Pipeline{
+		Namespaces: namespaces,
+		Filters:    filters,
+	}
+}
+
+/*
+ * Creates the stores of the reloaded namespaces that replace a store (see Reload_namespace), before the pipeline
+ * is published: a namespace whose store can't be created keeps the previous namespace
+ */
+func (pipeline *Pipeline) Take_over_stores() {
+	for name, namespace := range pipeline.Namespaces {
+		if namespace.replaces == nil {
+			continue
+		}
+		if err := namespace.take_over(); err != nil {
+			logrus.Errorf("Take_over_stores: %+v, keeping the previous namespace %s", err, name)
+			pipeline.Namespaces[name] = namespace.replaces
+		}
+	}
+}
+
+// shortest interval between ticks of the stores
+const min_tick_interval = 10 * time.Millisecond
+
+/*
+ * Interval between ticks of the stores: the smallest granularity of the namespaces (sub-second time units),
+ * at most max
+ */
+func (pipeline *Pipeline) Tick_interval(max time.Duration) time.Duration {
+	interval := max
+	for _, namespace := range pipeline.Namespaces {
+		if granularity := time.Duration(namespace.Granularity) * namespace.unit(); granularity < interval {
+			interval = granularity
+		}
+	}
+	if interval < min_tick_interval {
+		return min_tick_interval
+	}
+	return interval
+}
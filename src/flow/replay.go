@@ -0,0 +1,164 @@
+package flow
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"example.com/streaming-metrics/src/prom_metrics"
+
+	"github.com/sirupsen/logrus"
+)
+
+/*
+ * Replay - processes recorded messages in event time
+ *
+ *	The stores advance with the message publish time (instead of the wall clock)
+ *	and every monitor runs at each simulated granularity*snapshot boundary.
+ */
+
+type Replay struct {
+	namespaces map[string]*Namespace
+	filters    *Filter_root
+	sink       Sink
+
+	current  time.Time
+	next_run map[string]time.Time
+}
+
+type Replay_alarm struct {
+	Time      time.Time       `json:"time"`
+	Namespace string          `json:"namespace"`
+	Monitor   json.RawMessage `json:"monitor"`
+}
+
+func New_replay(namespaces map[string]*Namespace, filters *Filter_root, sink Sink) *Replay {
+	return &Replay{
+		namespaces: namespaces,
+		filters:    filters,
+		sink:       sink,
+		next_run:   make(map[string]time.Time),
+	}
+}
+
+func (replay *Replay) Run(source Source) {
+	n_msgs := 0
+	for msg := range source.Messages() {
+		replay.Process(msg)
+		if err := source.Ack(msg); err != nil {
+			logrus.Warnf("replay ack err: %+v", err)
+		}
+		n_msgs++
+	}
+	logrus.Infof("replay done: %d messages (last time %v)", n_msgs, replay.current)
+}
+
+func (replay *Replay) Process(msg Message) {
+	t := msg.PublishTime()
+	if t.IsZero() {
+		logrus.Warnf("replay message without publish time, using current replay time %v", replay.current)
+		t = replay.current
+	}
+
+	replay.Advance(t)
+
+	push_metrics(msg, filter(msg, replay.filters, nil), replay.namespaces, nil, nil)
+
+	for _, name := range sorted_names(replay.namespaces) {
+		replay.tick(replay.namespaces[name], replay.current)
+	}
+}
+
+// ticks namespace to t, running its bucket close programs if the bucket group moved
+func (replay *Replay) tick(namespace *Namespace, t time.Time) {
+	if namespace.tick(t) && namespace.bucket_close_trigger() {
+		for _, payload := range namespace.run_bucket_close() {
+			replay.emit(t, namespace.Namespace, payload)
+		}
+		prom_metrics.Prom_metric.Inc_monitors_ticks(namespace.Namespace)
+	}
+}
+
+/*
+ * Runs every monitor boundary up to t (inclusive), in chronological order
+ */
+func (replay *Replay) Advance(t time.Time) {
+	if t.Before(replay.current) {
+		return
+	}
+
+	if replay.current.IsZero() {
+		for name, namespace := range replay.namespaces {
+			if namespace.monitor_trigger() != "bucket_close" {
+				replay.next_run[name] = namespace.event_schedule().next(t)
+			}
+		}
+	}
+
+	for {
+		name, run_at, ok := replay.next_due(t)
+		if !ok {
+			break
+		}
+		namespace := replay.namespaces[name]
+
+		replay.tick(namespace, run_at)
+		for _, payload := range namespace.run_monitor() {
+			replay.emit(run_at, name, payload)
+		}
+		prom_metrics.Prom_metric.Inc_monitors_ticks(name)
+
+		replay.next_run[name] = namespace.event_schedule().next(run_at)
+	}
+
+	replay.current = t
+}
+
+func (replay *Replay) next_due(t time.Time) (string, time.Time, bool) {
+	names := make([]string, 0, len(replay.next_run))
+	for name, run_at := range replay.next_run {
+		if !run_at.After(t) {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return "", time.Time{}, false
+	}
+
+	sort.Slice(names, func(i, j int) bool {
+		ti, tj := replay.next_run[names[i]], replay.next_run[names[j]]
+		if ti.Equal(tj) {
+			return names[i] < names[j]
+		}
+		return ti.Before(tj)
+	})
+	return names[0], replay.next_run[names[0]], true
+}
+
+func (replay *Replay) emit(t time.Time, namespace string, payload []byte) {
+	alarm, err := json.Marshal(&Replay_alarm{
+		Time:      t.UTC(),
+		Namespace: namespace,
+		Monitor:   payload,
+	})
+	if err != nil {
+		logrus.Errorf("replay marshal: %+v", err)
+		return
+	}
+	replay.sink.Send(namespace, alarm, send_callback(namespace))
+}
+
+func sorted_names(namespaces map[string]*Namespace) []string {
+	names := make([]string, 0, len(namespaces))
+	for name := range namespaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// first boundary (aligned to the unix epoch) after t
+func next_boundary(t time.Time, interval time.Duration) time.Time {
+	ns := t.UnixNano()
+	return time.Unix(0, ns-ns%int64(interval)+int64(interval))
+}
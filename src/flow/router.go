@@ -0,0 +1,98 @@
+package flow
+
+import (
+	"fmt"
+	"math/big"
+
+	"example.com/streaming-metrics/src/prom_metrics"
+
+	"github.com/itchyny/gojq"
+	"github.com/sirupsen/logrus"
+)
+
+/*
+ * Router - republishes the source messages keyed by the key program (groups/key.jq),
+ * so a Key_Shared subscription on the destination sends every message of an id
+ * to the same instance (and the same Memory_store)
+ *
+ *	the key should be the id (or a prefix of the id) the filters log
+ */
+
+type Router struct {
+	key          *gojq.Code
+	sink         Sink
+	dead_letters *Dead_letters
+}
+
+func New_router(key *gojq.Code, sink Sink, dead_letters *Dead_letters) *Router {
+	return &Router{
+		key:          key,
+		sink:         sink,
+		dead_letters: dead_letters,
+	}
+}
+
+/*
+ * Runs until the source is stopped, messages are acked once forwarded
+ */
+func (router *Router) Run(source Source) {
+	for msg := range source.Messages() {
+		key, err := router.route_key(msg)
+		if err != nil {
+			logrus.Errorf("Router: %+v", err)
+			router.dead_letters.Send("route_key", msg, "", "", err.Error())
+			if err := source.Ack(msg); err != nil {
+				logrus.Warnf("Router ack err: %+v", err)
+			}
+			continue
+		}
+
+		router.sink.Forward(key, msg, func(err error) {
+			if err != nil {
+				logrus.Errorf("Router forward: %+v", err)
+				source.Nack(msg)
+				return
+			}
+			prom_metrics.Prom_metric.Inc_routed_msg()
+			if err := source.Ack(msg); err != nil {
+				logrus.Warnf("Router ack err: %+v", err)
+			}
+		})
+	}
+}
+
+func (router *Router) route_key(msg Message) (string, error) {
+	var msg_json any
+	if err := unmarshal_payload(msg.Payload(), &msg_json); err != nil {
+		return "", fmt.Errorf("route_key unmarshal msg: %w", err)
+	}
+
+	// default jq timeout
+	var budget *Jq_budget
+	ctx, cancel := budget.context()
+	defer cancel()
+
+	v, ok := router.key.RunWithContext(ctx, msg_json, message_meta(msg)).Next()
+	if !ok {
+		return "", fmt.Errorf("route_key key.jq returned nothing")
+	}
+
+	switch key := v.(type) {
+	case error:
+		budget.exceeded("route_key", key)
+		return "", fmt.Errorf("route_key: %w", key)
+	case string:
+		// pulsar would send a message without a key to any consumer
+		if key == "" {
+			return "", fmt.Errorf("route_key key.jq returned an empty key")
+		}
+		return key, nil
+	case int, float64:
+		return fmt.Sprintf("%v", key), nil
+	// integers beyond int
+	case *big.Int:
+		return key.String(), nil
+	default:
+		return "", fmt.Errorf("route_key key.jq did not return a string: %+v", v)
+	}
+}
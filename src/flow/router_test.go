@@ -0,0 +1,48 @@
+package flow
+
+import (
+	"testing"
+
+	"github.com/itchyny/gojq"
+)
+
+func TestRoute_key(t *testing.T) {
+	query, err := gojq.Parse(".id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := gojq.Compile(query, gojq.WithVariables([]string{"$__meta"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := New_router(key, nil, nil)
+
+	cases := []struct {
+		payload string
+		key     string
+		valid   bool
+	}{
+		{`{"id": "w0"}`, "w0", true},
+		{`{"id": 12}`, "12", true},
+		{`{"id": 1.5}`, "1.5", true},
+		{`{"id": 9223372036854775807}`, "9223372036854775807", true},
+		{`{"id": 123456789012345678901234567890}`, "123456789012345678901234567890", true},
+		{`{"id": ""}`, "", false},
+		{`{"id": null}`, "", false},
+		{`{"id": [1]}`, "", false},
+		{`not json`, "", false},
+	}
+
+	for _, c := range cases {
+		k, err := router.route_key(&File_message{payload: []byte(c.payload), properties: map[string]string{}})
+		if !c.valid {
+			if err == nil {
+				t.Errorf("route_key(%s) = %q, expected an error", c.payload, k)
+			}
+			continue
+		}
+		if err != nil || k != c.key {
+			t.Errorf("route_key(%s) = %q %v, expected %q", c.payload, k, err, c.key)
+		}
+	}
+}
@@ -0,0 +1,315 @@
+package flow
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * Monitor schedules of the wall clock monitors (namespace schedule):
+ *
+ *	interval (default) - every granularity*snapshot from the process start
+ *	aligned - at the granularity*snapshot boundaries of the unix epoch
+ *	cron expression - "minute hour day-of-month month day-of-week" (*, lists, ranges and steps)
+ *
+ *	schedule_offset delays every boundary, schedule_jitter adds a random delay to every run
+ */
+
+type schedule interface {
+	// first run strictly after t
+	next(t time.Time) time.Time
+	// shortest time between two runs
+	shortest_gap() time.Duration
+}
+
+type interval_schedule struct {
+	interval time.Duration
+}
+
+func (s *interval_schedule) next(t time.Time) time.Time { return t.Add(s.interval) }
+
+func (s *interval_schedule) shortest_gap() time.Duration { return s.interval }
+
+type aligned_schedule struct {
+	interval time.Duration
+	offset   time.Duration
+}
+
+func (s *aligned_schedule) next(t time.Time) time.Time {
+	return next_boundary(t.Add(-s.offset), s.interval).Add(s.offset)
+}
+
+func (s *aligned_schedule) shortest_gap() time.Duration { return s.interval }
+
+func (namespace *Namespace) monitor_schedule() (schedule, error) {
+	offset, err := parse_optional_duration(namespace.Schedule_offset)
+	if err != nil {
+		return nil, fmt.Errorf("schedule_offset: %w", err)
+	}
+
+	switch namespace.Schedule {
+	case "", "interval":
+		return &interval_schedule{interval: namespace.interval()}, nil
+	case "aligned":
+		return &aligned_schedule{interval: namespace.interval(), offset: offset}, nil
+	default:
+		cron, err := parse_cron(namespace.Schedule)
+		if err != nil {
+			return nil, err
+		}
+		cron.offset = offset
+		return cron, nil
+	}
+}
+
+// runs on the watermark or the replayed time: interval has no process start and is aligned
+func (namespace *Namespace) event_schedule() schedule {
+	if namespace.Schedule == "" || namespace.Schedule == "interval" {
+		return &aligned_schedule{interval: namespace.interval()}
+	}
+	schedule, err := namespace.monitor_schedule()
+	if err != nil {
+		return &aligned_schedule{interval: namespace.interval()}
+	}
+	return schedule
+}
+
+func (namespace *Namespace) schedule_jitter() time.Duration {
+	jitter, _ := parse_optional_duration(namespace.Schedule_jitter)
+	if jitter <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(jitter)))
+}
+
+// identifies the schedule, a ticker is restarted when it changes
+func (namespace *Namespace) schedule_key() string {
+	return fmt.Sprintf("%v|%s|%s|%s|%s", namespace.interval(), namespace.Schedule, namespace.Schedule_offset, namespace.Schedule_jitter, namespace.Overlap_policy)
+}
+
+func (namespace *Namespace) check_schedule() []string {
+	problems := make([]string, 0)
+
+	schedule, err := namespace.monitor_schedule()
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("schedule: %v", err))
+	}
+	jitter, err := parse_optional_duration(namespace.Schedule_jitter)
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("schedule_jitter: %v", err))
+	}
+	// the next run would be due before the delayed one, every run would be missed
+	if schedule != nil && jitter > 0 && jitter >= schedule.shortest_gap() {
+		problems = append(problems, fmt.Sprintf("schedule_jitter %v must be shorter than the shortest time between two runs (%v)", jitter, schedule.shortest_gap()))
+	}
+	switch namespace.Overlap_policy {
+	case "", "queue", "skip", "coalesce":
+	default:
+		problems = append(problems, fmt.Sprintf("%s is not a valid overlap_policy (queue - skip - coalesce)", namespace.Overlap_policy))
+	}
+
+	return problems
+}
+
+func valid_optional_duration(duration string) bool {
+	_, err := parse_optional_duration(duration)
+	return err == nil
+}
+
+func parse_optional_duration(duration string) (time.Duration, error) {
+	if duration == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(duration)
+}
+
+/*
+ * Overlap of the runs of a monitor (overlap_policy):
+ *
+ *	queue (default) - every run is queued
+ *	skip - no run while the previous one is queued or running
+ *	coalesce - no run while the previous one is still queued
+ */
+
+type monitor_runs struct {
+	queued  atomic.Int64
+	running atomic.Int64
+}
+
+func (runs *monitor_runs) dequeued() {
+	if runs != nil {
+		runs.queued.Add(-1)
+		runs.running.Add(1)
+	}
+}
+
+func (runs *monitor_runs) done() {
+	if runs != nil {
+		runs.running.Add(-1)
+	}
+}
+
+/*
+ * Cron
+ */
+
+type cron_schedule struct {
+	minutes  [60]bool
+	hours    [24]bool
+	days     [32]bool
+	months   [13]bool
+	weekdays [7]bool
+	any_day  bool
+	any_week bool
+	offset   time.Duration
+}
+
+func parse_cron(expression string) (*cron_schedule, error) {
+	fields := strings.Fields(expression)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("%q is not interval, aligned or a cron expression (minute hour day-of-month month day-of-week)", expression)
+	}
+
+	cron := &cron_schedule{
+		any_day:  fields[2] == "*",
+		any_week: fields[4] == "*",
+	}
+	parts := []struct {
+		field    string
+		set      []bool
+		min, max int
+	}{
+		{fields[0], cron.minutes[:], 0, 59},
+		{fields[1], cron.hours[:], 0, 23},
+		{fields[2], cron.days[:], 1, 31},
+		{fields[3], cron.months[:], 1, 12},
+		{fields[4], cron.weekdays[:], 0, 7},
+	}
+	for _, part := range parts {
+		if err := parse_cron_field(part.field, part.set, part.min, part.max); err != nil {
+			return nil, fmt.Errorf("cron %q: %w", expression, err)
+		}
+	}
+	// with a day-of-week both match, either one exists
+	if !cron.any_day && cron.any_week && !cron.days_exist() {
+		return nil, fmt.Errorf("cron %q: none of the months has the days of month, it never runs", expression)
+	}
+
+	return cron, nil
+}
+
+// a day of month of the schedule exists in one of its months (29th of february on leap years)
+func (cron *cron_schedule) days_exist() bool {
+	for month := time.January; month <= time.December; month++ {
+		if !cron.months[month] {
+			continue
+		}
+		days := time.Date(2024, month+1, 0, 0, 0, 0, 0, time.UTC).Day()
+		for day := 1; day <= days; day++ {
+			if cron.days[day] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// *, n, a-b, */s, a-b/s and comma lists of them; day-of-week 7 is sunday
+func parse_cron_field(field string, set []bool, min int, max int) error {
+	for _, item := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(item, "/"); i >= 0 {
+			s, err := strconv.Atoi(item[i+1:])
+			if err != nil || s <= 0 {
+				return fmt.Errorf("invalid step %q", item)
+			}
+			step = s
+			item = item[:i]
+		}
+
+		from, to := min, max
+		if item != "*" {
+			bounds := strings.SplitN(item, "-", 2)
+			var err error
+			if from, err = strconv.Atoi(bounds[0]); err != nil {
+				return fmt.Errorf("invalid value %q", item)
+			}
+			to = from
+			if len(bounds) == 2 {
+				if to, err = strconv.Atoi(bounds[1]); err != nil {
+					return fmt.Errorf("invalid value %q", item)
+				}
+			} else if step > 1 {
+				to = max
+			}
+		}
+		if from < min || to > max || from > to {
+			return fmt.Errorf("%q out of range %d-%d", item, min, max)
+		}
+
+		for v := from; v <= to; v += step {
+			set[v%len(set)] = true
+		}
+	}
+	return nil
+}
+
+func (cron *cron_schedule) day_matches(t time.Time) bool {
+	day, weekday := cron.days[t.Day()], cron.weekdays[t.Weekday()]
+	switch {
+	case cron.any_day && cron.any_week:
+		return true
+	case cron.any_day:
+		return weekday
+	case cron.any_week:
+		return day
+	default:
+		// as in cron, either one
+		return day || weekday
+	}
+}
+
+func (cron *cron_schedule) next(after time.Time) time.Time {
+	t := after.Add(-cron.offset).Truncate(time.Minute).Add(time.Minute)
+
+	// a matching minute exists within 5 years (29th of february on a given weekday)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case !cron.months[t.Month()]:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !cron.day_matches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case !cron.hours[t.Hour()]:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case !cron.minutes[t.Minute()]:
+			t = t.Add(time.Minute)
+		default:
+			return t.Add(cron.offset)
+		}
+	}
+	return limit
+}
+
+// over the runs of 5 years (a leap year and the weekdays of every date), a minute at least
+func (cron *cron_schedule) shortest_gap() time.Duration {
+	start := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	limit := start.AddDate(5, 0, 0)
+	shortest := limit.Sub(start)
+
+	// the offset shifts every run, not the gaps
+	at := cron.next(start)
+	for shortest > time.Minute {
+		next := cron.next(at)
+		if !next.Before(limit.Add(cron.offset)) {
+			break
+		}
+		shortest = min(shortest, next.Sub(at))
+		at = next
+	}
+	return shortest
+}
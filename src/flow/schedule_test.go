@@ -0,0 +1,138 @@
+package flow
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParse_cron(t *testing.T) {
+	cases := []struct {
+		expression string
+		valid      bool
+	}{
+		{"* * * * *", true},
+		{"*/15 9-17 * * 1-5", true},
+		{"0,30 * 1,15 * *", true},
+		{"0 12 * * 7", true},
+		{"0 0 29 2 *", true},
+		{"0 0 31 1-12 *", true},
+		// either the day of month or the day of week
+		{"0 0 30 2 1", true},
+		{"0 0 30 2 *", false},
+		{"0 0 31 4,6,9,11 *", false},
+		{"0 0 30,31 2 *", false},
+		{"60 * * * *", false},
+		{"* 24 * * *", false},
+		{"* * 0 * *", false},
+		{"* * * 13 *", false},
+		{"* * * * 8", false},
+		{"5-1 * * * *", false},
+		{"*/0 * * * *", false},
+		{"a * * * *", false},
+		{"* * * *", false},
+		{"aligned", false},
+	}
+
+	for _, c := range cases {
+		_, err := parse_cron(c.expression)
+		if c.valid && err != nil {
+			t.Errorf("parse_cron(%q): %v", c.expression, err)
+		}
+		if !c.valid && err == nil {
+			t.Errorf("parse_cron(%q): expected an error", c.expression)
+		}
+	}
+}
+
+func TestCron_next(t *testing.T) {
+	at := func(s string) time.Time {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			panic(err)
+		}
+		return t
+	}
+
+	cases := []struct {
+		expression string
+		offset     time.Duration
+		after      string
+		next       string
+	}{
+		{"* * * * *", 0, "2024-01-01T10:07:30Z", "2024-01-01T10:08:00Z"},
+		{"*/15 * * * *", 0, "2024-01-01T10:07:30Z", "2024-01-01T10:15:00Z"},
+		// strictly after
+		{"30 * * * *", 0, "2024-01-01T10:30:00Z", "2024-01-01T11:30:00Z"},
+		{"0 9-17 * * *", 0, "2024-01-01T17:00:00Z", "2024-01-02T09:00:00Z"},
+		// friday to monday
+		{"0 9 * * 1-5", 0, "2024-01-05T09:00:00Z", "2024-01-08T09:00:00Z"},
+		{"0 12 * * 7", 0, "2024-01-01T00:00:00Z", "2024-01-07T12:00:00Z"},
+		// the 1st or a sunday
+		{"0 0 1 * 0", 0, "2024-01-01T00:00:00Z", "2024-01-07T00:00:00Z"},
+		{"0 0 31 * *", 0, "2024-04-01T00:00:00Z", "2024-05-31T00:00:00Z"},
+		{"0 0 29 2 *", 0, "2024-03-01T00:00:00Z", "2028-02-29T00:00:00Z"},
+		{"0 0 1 1 *", 0, "2024-06-15T08:00:00Z", "2025-01-01T00:00:00Z"},
+		{"*/5 * * * *", 2 * time.Second, "2024-01-01T10:05:01Z", "2024-01-01T10:05:02Z"},
+		{"*/5 * * * *", 2 * time.Second, "2024-01-01T10:05:02Z", "2024-01-01T10:10:02Z"},
+	}
+
+	for _, c := range cases {
+		cron, err := parse_cron(c.expression)
+		if err != nil {
+			t.Fatalf("parse_cron(%q): %v", c.expression, err)
+		}
+		cron.offset = c.offset
+		if next := cron.next(at(c.after)); !next.Equal(at(c.next)) {
+			t.Errorf("%q (offset %v) next(%s) = %s, expected %s", c.expression, c.offset, c.after, next.Format(time.RFC3339), c.next)
+		}
+	}
+}
+
+func TestShortest_gap(t *testing.T) {
+	cases := []struct {
+		expression string
+		gap        time.Duration
+	}{
+		{"* * * * *", time.Minute},
+		{"*/15 9-17 * * 1-5", 15 * time.Minute},
+		{"0 9,17 * * *", 8 * time.Hour},
+		{"0 0 * * 1,2", 24 * time.Hour},
+		{"0 0 1 * *", 28 * 24 * time.Hour},
+		{"0 0 29 2 *", 1461 * 24 * time.Hour},
+	}
+
+	for _, c := range cases {
+		cron, err := parse_cron(c.expression)
+		if err != nil {
+			t.Fatalf("parse_cron(%q): %v", c.expression, err)
+		}
+		if gap := cron.shortest_gap(); gap != c.gap {
+			t.Errorf("%q shortest_gap = %v, expected %v", c.expression, gap, c.gap)
+		}
+	}
+}
+
+func TestCheck_schedule_jitter(t *testing.T) {
+	cases := []struct {
+		schedule string
+		jitter   string
+		valid    bool
+	}{
+		{"", "", true},
+		{"", "9s", true},
+		{"", "10s", false},
+		{"aligned", "1m", false},
+		{"* * * * *", "59s", true},
+		{"* * * * *", "1m", false},
+		{"0 * * * *", "30m", true},
+		{"", "abc", false},
+	}
+
+	for _, c := range cases {
+		namespace := &Namespace{Granularity: 5, Snapshot: 2, Schedule: c.schedule, Schedule_jitter: c.jitter}
+		problems := namespace.check_schedule()
+		if c.valid != (len(problems) == 0) {
+			t.Errorf("schedule %q jitter %q: problems %v, expected valid %t", c.schedule, c.jitter, problems, c.valid)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package flow
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+	"github.com/sirupsen/logrus"
+)
+
+/*
+ * Sink
+ */
+
+type Sink interface {
+	/*
+	 * done is called once the payload was written (or failed to)
+	 */
+	Send(key string, payload []byte, done func(err error))
+
+	/*
+	 * Forward - sends msg (payload, properties, event time) with a new key
+	 */
+	Forward(key string, msg Message, done func(err error))
+
+	Flush() error
+	Close()
+}
+
+/*
+ * Pulsar_sink
+ */
+
+type Pulsar_sink struct {
+	client   pulsar.Client
+	producer pulsar.Producer
+}
+
+func New_pulsar_sink(client pulsar.Client, producer pulsar.Producer) *Pulsar_sink {
+	return &Pulsar_sink{
+		client:   client,
+		producer: producer,
+	}
+}
+
+func (sink *Pulsar_sink) Send(key string, payload []byte, done func(err error)) {
+	sink.producer.SendAsync(
+		context.Background(),
+		&pulsar.ProducerMessage{
+			Payload: payload,
+			Key:     key,
+		},
+		func(msgID pulsar.MessageID, pm *pulsar.ProducerMessage, err error) {
+			done(err)
+		},
+	)
+}
+
+func (sink *Pulsar_sink) Forward(key string, msg Message, done func(err error)) {
+	sink.producer.SendAsync(
+		context.Background(),
+		&pulsar.ProducerMessage{
+			Payload:    msg.Payload(),
+			Key:        key,
+			Properties: msg.Properties(),
+			EventTime:  msg.EventTime(),
+		},
+		func(msgID pulsar.MessageID, pm *pulsar.ProducerMessage, err error) {
+			done(err)
+		},
+	)
+}
+
+func (sink *Pulsar_sink) Flush() error {
+	return sink.producer.Flush()
+}
+
+func (sink *Pulsar_sink) Close() {
+	sink.producer.Close()
+	if sink.client != nil {
+		sink.client.Close()
+	}
+}
+
+/*
+ * File_sink - writes one payload per line to a file ("-" for stdout)
+ */
+
+type File_sink struct {
+	path  string
+	file  io.WriteCloser
+	mutex sync.Mutex
+}
+
+func New_file_sink(path string) (*File_sink, error) {
+	var file io.WriteCloser
+	if path == "-" {
+		file = os.Stdout
+	} else {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("New_file_sink %s: %w", path, err)
+		}
+		file = f
+	}
+
+	return &File_sink{
+		path: path,
+		file: file,
+	}, nil
+}
+
+func (sink *File_sink) Send(key string, payload []byte, done func(err error)) {
+	line := make([]byte, 0, len(payload)+1)
+	line = append(append(line, payload...), '\n')
+
+	done(sink.write(line))
+}
+
+// writes the envelope format of the file source
+func (sink *File_sink) Forward(key string, msg Message, done func(err error)) {
+	line, err := json.Marshal(&file_record{
+		Topic:        msg.Topic(),
+		Key:          key,
+		Payload:      msg.Payload(),
+		Properties:   msg.Properties(),
+		Publish_time: msg.PublishTime(),
+		Event_time:   msg.EventTime(),
+	})
+	if err != nil {
+		done(err)
+		return
+	}
+
+	done(sink.write(append(line, '\n')))
+}
+
+func (sink *File_sink) write(line []byte) error {
+	sink.mutex.Lock()
+	_, err := sink.file.Write(line)
+	sink.mutex.Unlock()
+
+	if err != nil {
+		logrus.Errorf("File_sink %s: %+v", sink.path, err)
+	}
+	return err
+}
+
+// writes are not buffered
+func (sink *File_sink) Flush() error { return nil }
+
+func (sink *File_sink) Close() {
+	if sink.path != "-" {
+		if err := sink.file.Close(); err != nil {
+			logrus.Errorf("File_sink close %s: %+v", sink.path, err)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package flow
+
+import (
+	"sync"
+	"time"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+	"github.com/sirupsen/logrus"
+)
+
+/*
+ * Source
+ */
+
+type Message interface {
+	Topic() string
+	Key() string
+	Payload() []byte
+	Properties() map[string]string
+	PublishTime() time.Time
+	EventTime() time.Time
+	RedeliveryCount() uint32
+}
+
+type Source interface {
+	/*
+	 * channel of messages to process, closed when the source has no more messages
+	 */
+	Messages() <-chan Message
+
+	Ack(msg Message) error
+	/*
+	 * acks msg and every message before it (of the same topic partition)
+	 */
+	Ack_cumulative(msg Message) error
+	Nack(msg Message)
+
+	/*
+	 * stops receiving messages, Messages() is closed once the messages already received are delivered
+	 */
+	Stop()
+
+	Close()
+}
+
+/*
+ * Pulsar_source
+ */
+
+// one consume_chan per consumer (one consumer per topic when each topic has to seek)
+type Pulsar_source struct {
+	client    pulsar.Client
+	consumers []pulsar.Consumer
+	messages  chan Message
+	stop      chan struct{}
+	stopped   sync.Once
+}
+
+func New_pulsar_source(client pulsar.Client, consumers []pulsar.Consumer, consume_chans []chan pulsar.ConsumerMessage) *Pulsar_source {
+	source := &Pulsar_source{
+		client:    client,
+		consumers: consumers,
+		messages:  make(chan Message, cap(consume_chans[0])),
+		stop:      make(chan struct{}),
+	}
+
+	var forwarding sync.WaitGroup
+	for _, consume_chan := range consume_chans {
+		forwarding.Add(1)
+		go func() {
+			defer forwarding.Done()
+			source.forward(consume_chan)
+		}()
+	}
+	go func() {
+		forwarding.Wait()
+		close(source.messages)
+	}()
+
+	return source
+}
+
+func (source *Pulsar_source) forward(consume_chan <-chan pulsar.ConsumerMessage) {
+	for {
+		select {
+		case msg, ok := <-consume_chan:
+			if !ok {
+				return
+			}
+			source.messages <- msg
+
+		case <-source.stop:
+			for {
+				select {
+				case msg, ok := <-consume_chan:
+					if !ok {
+						return
+					}
+					source.messages <- msg
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (source *Pulsar_source) Messages() <-chan Message {
+	return source.messages
+}
+
+func (source *Pulsar_source) Ack(msg Message) error {
+	switch m := msg.(type) {
+	case pulsar.ConsumerMessage:
+		return m.Consumer.Ack(m.Message)
+	default:
+		logrus.Errorf("Pulsar_source.Ack not a pulsar message: %+v", msg)
+		return nil
+	}
+}
+
+func (source *Pulsar_source) Ack_cumulative(msg Message) error {
+	switch m := msg.(type) {
+	case pulsar.ConsumerMessage:
+		return m.Consumer.AckCumulative(m.Message)
+	default:
+		logrus.Errorf("Pulsar_source.Ack_cumulative not a pulsar message: %+v", msg)
+		return nil
+	}
+}
+
+func (source *Pulsar_source) Nack(msg Message) {
+	switch m := msg.(type) {
+	case pulsar.ConsumerMessage:
+		m.Consumer.Nack(m.Message)
+	default:
+		logrus.Errorf("Pulsar_source.Nack not a pulsar message: %+v", msg)
+	}
+}
+
+func (source *Pulsar_source) Stop() {
+	source.stopped.Do(func() { close(source.stop) })
+}
+
+func (source *Pulsar_source) Close() {
+	source.Stop()
+	for _, consumer := range source.consumers {
+		consumer.Close()
+	}
+	source.client.Close()
+}
@@ -0,0 +1,193 @@
+package flow
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"example.com/streaming-metrics/src/prom_metrics"
+
+	"github.com/sirupsen/logrus"
+)
+
+/*
+ * Watermark - low watermark of the publish times read from every topic partition,
+ * the time the stores of all namespaces are ticked to
+ *
+ *	a partition without messages for idle_timeout stops holding the watermark back
+ *	(0 never), when every partition is idle the watermark is the latest time read
+ *	the watermark never goes back
+ *
+ * The event namespaces keep their own of the metric times read from every topic (see Namespace.clock)
+ */
+
+type Watermark struct {
+	idle_timeout time.Duration
+	partitions   map[string]*watermark_partition
+	watermark    time.Time
+	observed     atomic.Bool
+	mutex        sync.Mutex
+}
+
+type watermark_partition struct {
+	time      time.Time
+	last_seen time.Time
+}
+
+func New_watermark(idle_timeout time.Duration) *Watermark {
+	return &Watermark{
+		idle_timeout: idle_timeout,
+		partitions:   make(map[string]*watermark_partition),
+	}
+}
+
+func (watermark *Watermark) Observe(partition string, t time.Time) {
+	watermark.observed.Store(true)
+
+	watermark.mutex.Lock()
+	defer watermark.mutex.Unlock()
+
+	p, ok := watermark.partitions[partition]
+	if !ok {
+		p = &watermark_partition{}
+		watermark.partitions[partition] = p
+	}
+	if t.After(p.time) {
+		p.time = t
+	}
+	p.last_seen = time.Now()
+}
+
+/*
+ * Recomputes the watermark, returns it and whether any message was observed since the last call
+ */
+func (watermark *Watermark) Advance(now time.Time) (time.Time, bool) {
+	observed := watermark.observed.Swap(false)
+
+	t, active, idle := watermark.advance(now, watermark.idle_timeout)
+	prom_metrics.Prom_metric.Set_watermark(t, active, idle)
+
+	return t, observed
+}
+
+// returns the watermark and the number of active and idle partitions
+func (watermark *Watermark) advance(now time.Time, idle_timeout time.Duration) (time.Time, int, int) {
+	watermark.mutex.Lock()
+	defer watermark.mutex.Unlock()
+
+	var low, high time.Time
+	active, idle := 0, 0
+	for _, p := range watermark.partitions {
+		if p.time.After(high) {
+			high = p.time
+		}
+		if idle_timeout > 0 && now.Sub(p.last_seen) > idle_timeout {
+			idle++
+			continue
+		}
+		if active == 0 || p.time.Before(low) {
+			low = p.time
+		}
+		active++
+	}
+	if active == 0 {
+		low = high
+	}
+
+	if low.After(watermark.watermark) {
+		watermark.watermark = low
+	}
+
+	return watermark.watermark, active, idle
+}
+
+/*
+ * Ticks the stores of every namespace to its clock on each tick, until stop is closed,
+ * and runs the monitors of the watermark driven namespaces when their clock crosses their interval
+ * (on_bucket_close.jq or monitor_on_bucket_close when the bucket group of a store moves)
+ * (ends the backfill when the watermark reaches its until or a tick finds no new messages)
+ *
+ * A namespace without a clock yet (no message read) is not ticked, processing namespaces always are
+ */
+func Watermark_ticks(pipeline *atomic.Pointer[Pipeline], watermark *Watermark, backfill *Backfill, tick <-chan time.Time, monitor_tick_chan chan<- *Monitor_tick, stop <-chan struct{}) {
+	next_run := make(map[string]time.Time)
+	// per namespace, the bucket closes and the monitor runs apart
+	runs := make(map[string]*monitor_runs)
+	close_runs := make(map[string]*monitor_runs)
+	runs_of := func(all map[string]*monitor_runs, name string) *monitor_runs {
+		if _, ok := all[name]; !ok {
+			all[name] = &monitor_runs{}
+		}
+		return all[name]
+	}
+
+	for {
+		select {
+		case now := <-tick:
+			t, observed := watermark.Advance(now)
+			if !t.IsZero() {
+				backfill.advance(t)
+			}
+			namespaces := pipeline.Load().Namespaces
+			clocks := make(map[string]time.Time, len(namespaces))
+			closed := make([]*Namespace, 0)
+			for name, namespace := range namespaces {
+				clock := namespace.clock(t, now, watermark.idle_timeout)
+				if clock.IsZero() {
+					continue
+				}
+				clocks[name] = clock
+				if namespace.tick(clock) && namespace.bucket_close_trigger() {
+					closed = append(closed, namespace)
+				}
+			}
+			if !t.IsZero() && !observed {
+				backfill.idle()
+			}
+
+			// a skipped bucket close leaves its closed buckets queued for the next one
+			for _, namespace := range closed {
+				if !send_monitor_tick(namespace, runs_of(close_runs, namespace.Namespace), true, monitor_tick_chan, stop) {
+					logrus.Infof("Watermark_ticks done")
+					return
+				}
+			}
+
+			for name := range next_run {
+				if namespace, ok := namespaces[name]; !ok || namespace.monitor_trigger() != "watermark" {
+					delete(next_run, name)
+					delete(runs, name)
+				}
+			}
+			for name := range close_runs {
+				if namespace, ok := namespaces[name]; !ok || !namespace.bucket_close_trigger() {
+					delete(close_runs, name)
+				}
+			}
+			for name, namespace := range namespaces {
+				clock, ok := clocks[name]
+				if namespace.monitor_trigger() != "watermark" || !ok {
+					continue
+				}
+				run_at, ok := next_run[name]
+				if !ok {
+					next_run[name] = namespace.event_schedule().next(clock)
+					continue
+				}
+				if clock.Before(run_at) {
+					continue
+				}
+				// once, however many intervals were crossed
+				next_run[name] = namespace.event_schedule().next(clock)
+				if !send_monitor_tick(namespace, runs_of(runs, name), false, monitor_tick_chan, stop) {
+					logrus.Infof("Watermark_ticks done")
+					return
+				}
+			}
+
+		case <-stop:
+			logrus.Infof("Watermark_ticks done")
+			return
+		}
+	}
+}
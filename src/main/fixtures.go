@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/sirupsen/logrus"
+
+	"example.com/streaming-metrics/src/flow"
+	"example.com/streaming-metrics/src/prom_metrics"
+)
+
+/*
+ * test - runs the fixtures monitors_dir/<namespace>/tests/*.yaml
+ * (exits with 1 if any fixture fails)
+ */
+func test_monitors(opt opt) {
+	prom_metrics.Setup_prometheus(0, false)
+
+	fixture_files, err := filepath.Glob(filepath.Join(opt.monitorsdir, "*", "tests", "*.yaml"))
+	if err != nil {
+		logrus.Fatalf("test glob fixtures: %+v", err)
+	}
+	sort.Strings(fixture_files)
+
+	passed, failed := 0, 0
+	for _, fixture_file := range fixture_files {
+		namespace := filepath.Base(filepath.Dir(filepath.Dir(fixture_file)))
+		name := fmt.Sprintf("%s/%s", namespace, filepath.Base(fixture_file))
+
+		if ok := run_fixture(opt.monitorsdir, namespace, fixture_file, name); ok {
+			passed++
+		} else {
+			failed++
+		}
+	}
+
+	fmt.Printf("%d passed, %d failed\n", passed, failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+func run_fixture(monitors_dir string, namespace string, fixture_file string, name string) bool {
+	buf, err := os.ReadFile(fixture_file)
+	if err != nil {
+		fmt.Printf("FAIL %s: %+v\n", name, err)
+		return false
+	}
+
+	fixture, err := flow.New_fixture(buf)
+	if err != nil {
+		fmt.Printf("FAIL %s: %+v\n", name, err)
+		return false
+	}
+
+	// fresh stores for every fixture
+	pipeline, err := load_pipeline(monitors_dir, flow.New_offline_namespace)
+	if err != nil {
+		fmt.Printf("FAIL %s: %+v\n", name, err)
+		return false
+	}
+
+	result, err := fixture.Run(namespace, pipeline.Namespaces, pipeline.Filters)
+	if err != nil {
+		fmt.Printf("FAIL %s: %+v\n", name, err)
+		return false
+	}
+
+	if !result.Ok() {
+		fmt.Printf("FAIL %s %s\n%s", name, fixture.Description, result.Diff())
+		return false
+	}
+
+	fmt.Printf("ok   %s %s\n", name, fixture.Description)
+	return true
+}
@@ -39,30 +39,77 @@ func with_function_compile_test() gojq.CompilerOption {
 	return gojq.WithFunction("ctest", 1, 1, gojq_extentions.Compiled_test)
 }
 
-func load_jq(program_file string, options ...gojq.CompilerOption) *gojq.Code {
-	buf, err := os.ReadFile(program_file)
+/*
+ *	Compiler options of each program (shared by the runtime and validate)
+ */
 
+func monitor_options() []gojq.CompilerOption {
+	return []gojq.CompilerOption{}
+}
+
+func lambda_options() []gojq.CompilerOption {
+	return []gojq.CompilerOption{gojq.WithVariables([]string{"$state", "$metric"}), with_function_compile_test()}
+}
+
+func filter_options() []gojq.CompilerOption {
+	return []gojq.CompilerOption{gojq.WithVariables([]string{"$__meta"}), with_function_namespace_filter_error(), with_function_log(), with_function_compile_test()}
+}
+
+func group_filter_options() []gojq.CompilerOption {
+	return []gojq.CompilerOption{gojq.WithVariables([]string{"$__meta"}), with_function_group_filter_error(), with_function_compile_test()}
+}
+
+func load_jq(program_file string, options ...gojq.CompilerOption) *gojq.Code {
+	compiled_program, err := compile_jq(program_file, options...)
 	if err != nil {
-		logrus.Errorf("load_jq readfile %s: %+v", program_file, err)
+		logrus.Errorf("load_jq %+v", err)
 		return nil
 	}
+	return compiled_program
+}
 
-	program, err := gojq.Parse(string(buf))
+func compile_jq(program_file string, options ...gojq.CompilerOption) (*gojq.Code, error) {
+	program, err := parse_jq(program_file)
 	if err != nil {
-		logrus.Errorf("load_jq parse %s: %+v", program_file, err)
-		return nil
+		return nil, err
 	}
 
 	compiled_program, err := gojq.Compile(program, options...)
 	if err != nil {
-		logrus.Errorf("load_jq compile %s: %+v", program_file, err)
-		return nil
+		return nil, fmt.Errorf("compile %s: %w", program_file, err)
 	}
 
-	return compiled_program
+	return compiled_program, nil
 }
 
-func load_configs(monitors_dir string) []flow.Namespace {
+func parse_jq(program_file string) (*gojq.Query, error) {
+	buf, err := os.ReadFile(program_file)
+	if err != nil {
+		return nil, fmt.Errorf("readfile %s: %w", program_file, err)
+	}
+
+	program, err := gojq.Parse(string(buf))
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %w", program_file, err)
+	}
+
+	return program, nil
+}
+
+func load_pipeline(monitors_dir string, new_namespace func(buf []byte) *flow.Namespace) (*flow.Pipeline, error) {
+	configs := load_configs(monitors_dir, new_namespace)
+	namespaces := load_namespaces(monitors_dir, configs)
+	filters := load_filters(monitors_dir, configs)
+	if filters == nil {
+		return nil, fmt.Errorf("load_pipeline %s: unable to load filters", monitors_dir)
+	}
+	return flow.New_pipeline(namespaces, filters), nil
+}
+
+/*
+ * new_namespace - flow.New_namesapce, flow.New_offline_namespace (replay/test) or flow.Reload_namespace
+ */
+func load_configs(monitors_dir string, new_namespace func(buf []byte) *flow.Namespace) []flow.Namespace {
 	files, err := os.ReadDir(monitors_dir + "/configs/")
 	if err != nil {
 		logrus.Panicf("load_configs unable to open directory %s %+v", monitors_dir+"/configs/", err)
@@ -73,7 +120,7 @@ func load_configs(monitors_dir string) []flow.Namespace {
 		if !file.IsDir() {
 			buf, _ := os.ReadFile(monitors_dir + "/configs/" + file.Name())
 
-			if namespace := flow.New_namesapce(buf); namespace != nil {
+			if namespace := new_namespace(buf); namespace != nil {
 				namespaces = append(namespaces, *namespace)
 			} else {
 				logrus.Errorf("Unable to create namespace for file %s", file.Name())
@@ -90,14 +137,24 @@ func load_namespaces(monitors_dir string, configs []flow.Namespace) map[string]*
 		namespace := &configs[i]
 
 		path_monitor_jq := fmt.Sprintf("%s/%s/%s", monitors_dir, namespace.Namespace, "monitor.jq")
-		monitor := load_jq(path_monitor_jq)
+		monitor := load_jq(path_monitor_jq, monitor_options()...)
 
 		path_lambda_jq := fmt.Sprintf("%s/%s/%s", monitors_dir, namespace.Namespace, "lambda.jq")
-		lambda := load_jq(path_lambda_jq, gojq.WithVariables([]string{"$state", "$metric"}), with_function_compile_test())
+		lambda := load_jq(path_lambda_jq, lambda_options()...)
+
+		// optional
+		var on_bucket_close *gojq.Code
+		path_on_bucket_close_jq := fmt.Sprintf("%s/%s/%s", monitors_dir, namespace.Namespace, "on_bucket_close.jq")
+		if _, err := os.Stat(path_on_bucket_close_jq); err == nil {
+			if on_bucket_close = load_jq(path_on_bucket_close_jq, monitor_options()...); on_bucket_close == nil {
+				continue
+			}
+		}
 
 		if monitor != nil && lambda != nil {
 			namespace.Set_monitor(monitor)
 			namespace.Set_lambda(lambda)
+			namespace.Set_on_bucket_close(on_bucket_close)
 			namespaces[namespace.Namespace] = namespace
 		}
 
@@ -107,6 +164,9 @@ func load_namespaces(monitors_dir string, configs []flow.Namespace) map[string]*
 
 func load_filters(monitors_dir string, configs []flow.Namespace) *flow.Filter_root {
 	filters := load_group_filters(monitors_dir)
+	if filters == nil {
+		return nil
+	}
 	for i := 0; i < len(configs); i++ {
 		namespace := &configs[i]
 		group := filters.Get_group(namespace.Group)
@@ -118,9 +178,11 @@ func load_filters(monitors_dir string, configs []flow.Namespace) *flow.Filter_ro
 			)
 		}
 		path_filter_jq := fmt.Sprintf("%s/%s/%s", monitors_dir, namespace.Namespace, "filter.jq")
-		if filter := load_jq(path_filter_jq, with_function_namespace_filter_error(), with_function_log(), with_function_compile_test()); filter != nil {
+		if filter := load_jq(path_filter_jq, filter_options()...); filter != nil {
 			group.Add_child(&flow.Leaf_node{
-				Filter: filter,
+				Namespace: namespace.Namespace,
+				Filter:    filter,
+				Budget:    namespace.Budget(),
 			})
 		}
 	}
@@ -129,9 +191,9 @@ func load_filters(monitors_dir string, configs []flow.Namespace) *flow.Filter_ro
 
 func load_group_filters(monitors_dir string) *flow.Filter_root {
 	path_group_filter_jq := fmt.Sprintf("%s/%s/%s", monitors_dir, "groups", "groups.jq")
-	if group_filter := load_jq(path_group_filter_jq, with_function_group_filter_error(), with_function_compile_test()); group_filter != nil {
+	if group_filter := load_jq(path_group_filter_jq, group_filter_options()...); group_filter != nil {
 		return flow.New_filter_tree(group_filter)
 	}
-	logrus.Panicf("load_group_filters no group filter")
+	logrus.Errorf("load_group_filters no group filter")
 	return nil
 }
@@ -1,7 +1,14 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/apache/pulsar-client-go/pulsar"
@@ -10,6 +17,7 @@ import (
 
 	"example.com/streaming-metrics/src/flow"
 	"example.com/streaming-metrics/src/prom_metrics"
+	"example.com/streaming-metrics/src/store/memory_store"
 )
 
 func logging(level string) {
@@ -53,77 +61,344 @@ func new_client(url string, trust_cert_file string, cert_file string, key_file s
 	return client
 }
 
+func new_source(opt opt) flow.Source {
+	switch opt.sourcetype {
+	case "pulsar":
+		source_client := new_client(opt.sourcepulsar, opt.sourcetrustcerts, opt.sourcecertfile, opt.sourcekeyfile, opt.sourceallowinsecureconnection)
+
+		start, err := parse_source_start(opt.sourcestart)
+		if err != nil {
+			logrus.Fatalln("Failed parse source_start. Reason: ", err)
+		}
+
+		topics := strings.Split(opt.sourcetopic, ";")
+		// a multi topic consumer can not seek, one consumer per topic
+		subscriptions := [][]string{topics}
+		if !start.time.IsZero() {
+			subscriptions = make([][]string, 0, len(topics))
+			for _, topic := range topics {
+				subscriptions = append(subscriptions, []string{topic})
+			}
+		} else if start.message_id != nil && len(topics) > 1 {
+			logrus.Fatalln("source_start message id requires a single source_topic")
+		}
+
+		consumers := make([]pulsar.Consumer, 0, len(subscriptions))
+		consume_chans := make([]chan pulsar.ConsumerMessage, 0, len(subscriptions))
+		for _, subscription_topics := range subscriptions {
+			consume_chan := make(chan pulsar.ConsumerMessage, 2000)
+
+			consumer, err := source_client.Subscribe(pulsar.ConsumerOptions{
+				Topics:                      subscription_topics,
+				SubscriptionName:            opt.sourcesubscription,
+				Name:                        opt.sourcename,
+				Type:                        subscription_type(opt.sourcesubscriptiontype),
+				SubscriptionInitialPosition: pulsar.SubscriptionPositionLatest,
+				MessageChannel:              consume_chan,
+				ReceiverQueueSize:           2000,
+			})
+			if err != nil {
+				logrus.Fatalln("Failed create consumer. Reason: ", err)
+			}
+
+			if !start.time.IsZero() {
+				err = consumer.SeekByTime(start.time)
+			} else if start.message_id != nil {
+				err = consumer.Seek(start.message_id)
+			}
+			if err != nil {
+				logrus.Fatalf("Failed seek %v to %s. Reason: %+v", subscription_topics, opt.sourcestart, err)
+			}
+
+			consumers = append(consumers, consumer)
+			consume_chans = append(consume_chans, consume_chan)
+		}
+
+		return flow.New_pulsar_source(source_client, consumers, consume_chans)
+
+	case "file":
+		source, err := flow.New_file_source(opt.sourcefile, opt.sourcefileformat)
+		if err != nil {
+			logrus.Fatalln("Failed create file source. Reason: ", err)
+		}
+		return source
+
+	default:
+		logrus.Fatalf("%s is not a valid source_type", opt.sourcetype)
+		return nil
+	}
+}
+
+/*
+ * Where the source subscription starts (zero values: latest, the subscription position)
+ *
+ *	latest - earliest - RFC3339 time - message id ledger:entry[:partition[:batch]]
+ */
+type source_start struct {
+	time       time.Time
+	message_id pulsar.MessageID
+}
+
+func parse_source_start(start string) (*source_start, error) {
+	switch start {
+	case "latest":
+		return &source_start{}, nil
+	case "earliest":
+		return &source_start{time: time.Unix(0, 0)}, nil
+	}
+
+	if t, err := time.Parse(time.RFC3339Nano, start); err == nil {
+		return &source_start{time: t}, nil
+	}
+
+	parts := strings.Split(start, ":")
+	if len(parts) < 2 || len(parts) > 4 {
+		return nil, fmt.Errorf("%s is not latest, earliest, a RFC3339 time or a message id", start)
+	}
+	ids := []int64{0, 0, 0, -1}
+	for i, part := range parts {
+		id, err := strconv.ParseInt(part, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not latest, earliest, a RFC3339 time or a message id", start)
+		}
+		ids[i] = id
+	}
+
+	return &source_start{message_id: pulsar.NewMessageID(ids[0], ids[1], int32(ids[3]), int32(ids[2]))}, nil
+}
+
+func subscription_type(name string) pulsar.SubscriptionType {
+	switch name {
+	case "exclusive":
+		return pulsar.Exclusive
+	case "failover":
+		return pulsar.Failover
+	case "key_shared":
+		return pulsar.KeyShared
+	default:
+		logrus.Fatalf("%s is not a valid source_subscription_type (exclusive - failover - key_shared)", name)
+		return pulsar.Exclusive
+	}
+}
+
+func new_sink(opt opt) flow.Sink {
+	switch opt.desttype {
+	case "pulsar":
+		dest_client := new_client(opt.destpulsar, opt.desttrustcerts, opt.destcertfile, opt.destkeyfile, opt.destallowinsecureconnection)
+
+		producer, err := dest_client.CreateProducer(pulsar.ProducerOptions{
+			Topic:                   opt.desttopic,
+			Name:                    opt.destname,
+			BatchingMaxPublishDelay: time.Millisecond * time.Duration(opt.batchmaxpublishdelay),
+			BatchingMaxMessages:     opt.batchmaxmessages,
+			BatchingMaxSize:         opt.batchingmaxsize,
+		})
+		if err != nil {
+			logrus.Fatalln("Failed create producer. Reason: ", err)
+		}
+
+		return flow.New_pulsar_sink(dest_client, producer)
+
+	case "file":
+		sink, err := flow.New_file_sink(opt.destfile)
+		if err != nil {
+			logrus.Fatalln("Failed create file sink. Reason: ", err)
+		}
+		return sink
+
+	default:
+		logrus.Fatalf("%s is not a valid dest_type", opt.desttype)
+		return nil
+	}
+}
+
+/*
+ * Sink of a side output (dead letters, late metrics): none (nil) - pulsar (on dest_pulsar) - file
+ */
+func new_side_sink(opt opt, name string, sink_type string, topic string, file string) flow.Sink {
+	switch sink_type {
+	case "none":
+		return nil
+
+	case "pulsar":
+		side_client := new_client(opt.destpulsar, opt.desttrustcerts, opt.destcertfile, opt.destkeyfile, opt.destallowinsecureconnection)
+
+		producer, err := side_client.CreateProducer(pulsar.ProducerOptions{
+			Topic:                   topic,
+			Name:                    opt.destname + "_" + name,
+			BatchingMaxPublishDelay: time.Millisecond * time.Duration(opt.batchmaxpublishdelay),
+			BatchingMaxMessages:     opt.batchmaxmessages,
+			BatchingMaxSize:         opt.batchingmaxsize,
+		})
+		if err != nil {
+			logrus.Fatalf("Failed create %s producer. Reason: %+v", name, err)
+		}
+
+		return flow.New_pulsar_sink(side_client, producer)
+
+	case "file":
+		sink, err := flow.New_file_sink(file)
+		if err != nil {
+			logrus.Fatalf("Failed create %s file sink. Reason: %+v", name, err)
+		}
+		return sink
+
+	default:
+		logrus.Fatalf("%s is not a valid %s_type", sink_type, name)
+		return nil
+	}
+}
+
+func new_dead_letters(opt opt) *flow.Dead_letters {
+	return flow.New_dead_letters(new_side_sink(opt, "dead_letter", opt.deadlettertype, opt.deadlettertopic, opt.deadletterfile))
+}
+
+func new_late_metrics(opt opt) *flow.Late_metrics {
+	return flow.New_late_metrics(new_side_sink(opt, "late", opt.latetype, opt.latetopic, opt.latefile))
+}
+
 func main() {
 	opt := from_args()
 	logging(opt.loglevel)
 	logrus.Infof("%+v", opt)
 
-	go prom_metrics.Setup_prometheus(opt.prometheusport, opt.activate_observe_processing_time)
+	flow.Set_default_jq_timeout(time.Duration(opt.jqtimeoutms) * time.Millisecond)
+	memory_store.Set_persistence_options(memory_store.Persistence_options{
+		Dir:           opt.pebbledir,
+		Wal_dir:       opt.pebblewaldir,
+		Disable_wal:   opt.pebbledisablewal,
+		Cache_size:    int64(opt.pebblecachemb) << 20,
+		Sync_interval: time.Duration(opt.pebblesyncintervalms) * time.Millisecond,
+		Read_only:     opt.command == "export",
+	})
 
-	// Clients
-	source_client := new_client(opt.sourcepulsar, opt.sourcetrustcerts, opt.sourcecertfile, opt.sourcekeyfile, opt.sourceallowinsecureconnection)
-	dest_client := new_client(opt.destpulsar, opt.desttrustcerts, opt.destcertfile, opt.destkeyfile, opt.destallowinsecureconnection)
+	switch opt.command {
+	case "", "run":
+		run(opt)
+	case "route":
+		route(opt)
+	case "replay":
+		replay(opt)
+	case "test":
+		test_monitors(opt)
+	case "validate":
+		validate(opt)
+	case "export":
+		export_snapshot(opt)
+	case "import":
+		import_snapshot(opt)
+	default:
+		logrus.Fatalf("%s is not a valid command (run - route - replay - test - validate - export - import)", opt.command)
+	}
+}
 
-	defer source_client.Close()
-	defer dest_client.Close()
+func run(opt opt) {
+	prom_metrics.Setup_prometheus(opt.prometheusport, opt.activate_observe_processing_time)
 
-	consume_chan := make(chan pulsar.ConsumerMessage, 2000)
-	monitor_ticker_chan := make(chan *string, 500)
-	write_chan := make(chan *flow.Write_struct, 2000)
-	ack_chan := make(chan pulsar.ConsumerMessage, 2000)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
-	consumer, err := source_client.Subscribe(pulsar.ConsumerOptions{
-		Topics:                      strings.Split(opt.sourcetopic, ";"),
-		SubscriptionName:            opt.sourcesubscription,
-		Name:                        opt.sourcename,
-		Type:                        pulsar.Exclusive,
-		SubscriptionInitialPosition: pulsar.SubscriptionPositionLatest,
-		MessageChannel:              consume_chan,
-		ReceiverQueueSize:           2000,
-	})
-	if err != nil {
-		logrus.Fatalln("Failed create consumer. Reason: ", err)
+	w := &workers{
+		source:              new_source(opt),
+		sink:                new_sink(opt),
+		dead_letters:        new_dead_letters(opt),
+		late_metrics:        new_late_metrics(opt),
+		monitor_ticker_chan: make(chan *flow.Monitor_tick, 500),
+		write_chan:          make(chan *flow.Write_struct, 2000),
+		ack_chan:            make(chan flow.Message, 2000),
+		acks_done:           make(chan struct{}),
+		watermark_stop:      make(chan struct{}),
+		watermark_done:      make(chan struct{}),
+		producer_done:       make(chan struct{}),
 	}
 
-	producer, err := dest_client.CreateProducer(pulsar.ProducerOptions{
-		Topic:                   opt.desttopic,
-		Name:                    opt.destname,
-		BatchingMaxPublishDelay: time.Millisecond * time.Duration(opt.batchmaxpublishdelay),
-		BatchingMaxMessages:     opt.batchmaxmessages,
-		BatchingMaxSize:         opt.batchingmaxsize,
-	})
+	loaded, err := load_pipeline(opt.monitorsdir, flow.New_namesapce)
 	if err != nil {
-		logrus.Fatalln("Failed create producer. Reason: ", err)
+		logrus.Panicf("Failed load monitors. Reason: %+v", err)
 	}
+	pipeline := &atomic.Pointer[flow.Pipeline]{}
+	pipeline.Store(loaded)
 
-	defer consumer.Close()
-	defer producer.Close()
+	if opt.adminon {
+		serve_admin(opt, pipeline)
+	}
 
-	configs := load_configs(opt.monitorsdir)
-	namespaces := load_namespaces(opt.monitorsdir, configs)
-	filters := load_filters(opt.monitorsdir, configs)
+	// started from the past: rebuild the windows before alarming
+	var backfill *flow.Backfill
+	if opt.sourcetype == "pulsar" && opt.sourcestart != "latest" {
+		backfill = flow.New_backfill(time.Now())
+	}
 
-	prom_metrics.Prom_metric.Number_of_namespaces(len(namespaces))
+	prom_metrics.Prom_metric.Number_of_namespaces(len(loaded.Namespaces))
 
 	// Logic
-	go flow.Producer(write_chan, producer)
+	go func() {
+		defer close(w.producer_done)
+		flow.Producer(w.write_chan, w.sink)
+	}()
 
-	tick := time.NewTicker(time.Second * time.Duration(opt.tickerseconds))
+	watermark := flow.New_watermark(time.Duration(opt.watermarkidleseconds) * time.Second)
 	for i := 0; i < int(opt.consumerthreads); i++ {
-		go flow.Consumer(consume_chan, ack_chan, namespaces, filters, tick.C)
+		w.consumers.Add(1)
+		go func() {
+			defer w.consumers.Done()
+			flow.Consumer(w.source.Messages(), w.ack_chan, pipeline, w.dead_letters, w.late_metrics, watermark)
+		}()
 	}
 
+	max_tick := time.Second * time.Duration(opt.tickerseconds)
+	w.tick = time.NewTicker(loaded.Tick_interval(max_tick))
+	go func() {
+		defer close(w.watermark_done)
+		flow.Watermark_ticks(pipeline, watermark, backfill, w.tick.C, w.monitor_ticker_chan, w.watermark_stop)
+	}()
+
 	for i := 0; i < int(opt.monitorthreads); i++ {
-		go flow.Alarm(namespaces, monitor_ticker_chan, write_chan)
+		w.alarms.Add(1)
+		go func() {
+			defer w.alarms.Done()
+			flow.Alarm(pipeline, backfill, w.monitor_ticker_chan, w.write_chan)
+		}()
 	}
 
-	for _, namespace := range namespaces {
-		go flow.Alarm_ticker(namespace, monitor_ticker_chan)
-	}
+	w.tickers = flow.New_alarm_tickers(w.monitor_ticker_chan)
+	w.tickers.Update(loaded.Namespaces)
+
+	w.reloader.Add(1)
+	go func() {
+		defer w.reloader.Done()
+		reload_on_changes(ctx, opt.monitorsdir, time.Duration(opt.reloadpollseconds)*time.Second, pipeline, w.tickers, func(loaded *flow.Pipeline) {
+			w.tick.Reset(loaded.Tick_interval(max_tick))
+		})
+	}()
 
 	if opt.pprofon {
 		go activate_profiling(opt.pprofdir, time.Duration(opt.pprofduration)*time.Second)
 	}
 
-	flow.Acks(consumer, ack_chan)
+	go func() {
+		defer close(w.acks_done)
+		if opt.checkpointintervalms > 0 {
+			cumulative := opt.checkpointcumulative
+			if cumulative && opt.consumerthreads > 1 {
+				logrus.Warnf("checkpoint_cumulative requires consumer_threads 1, using individual acks")
+				cumulative = false
+			}
+			if cumulative && opt.sourcesubscriptiontype == "key_shared" {
+				logrus.Warnf("checkpoint_cumulative is not supported on key_shared subscriptions, using individual acks")
+				cumulative = false
+			}
+			flow.Checkpoint_acks(w.source, w.ack_chan, time.Duration(opt.checkpointintervalms)*time.Millisecond, cumulative)
+		} else {
+			flow.Acks(w.source, w.ack_chan)
+		}
+	}()
+
+	<-ctx.Done()
+	stop()
+	logrus.Infof("shutdown: signal received, deadline %ds", opt.shutdowntimeoutseconds)
+
+	if !w.shutdown(time.Duration(opt.shutdowntimeoutseconds) * time.Second) {
+		os.Exit(1)
+	}
 }
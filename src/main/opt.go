@@ -1,19 +1,33 @@
 package main
 
 import (
+	"os"
+	"strings"
+
 	"github.com/jnovack/flag"
 )
 
 type opt struct {
+	command string
+
+	sourcetype       string
+	sourcefile       string
+	sourcefileformat string
+
 	sourcepulsar                  string
 	sourcetopic                   string
 	sourcesubscription            string
+	sourcesubscriptiontype        string
+	sourcestart                   string
 	sourcename                    string
 	sourcetrustcerts              string
 	sourcecertfile                string
 	sourcekeyfile                 string
 	sourceallowinsecureconnection bool
 
+	desttype string
+	destfile string
+
 	destpulsar                  string
 	desttopic                   string
 	destsubscription            string
@@ -42,21 +56,65 @@ type opt struct {
 	loglevel string
 
 	tickerseconds uint
+
+	watermarkidleseconds uint
+
+	reloadpollseconds uint
+
+	shutdowntimeoutseconds uint
+
+	checkpointintervalms uint
+	checkpointcumulative bool
+
+	validatestrict bool
+
+	jqtimeoutms uint
+
+	pebbledir            string
+	pebblewaldir         string
+	pebbledisablewal     bool
+	pebblecachemb        uint
+	pebblesyncintervalms uint
+
+	snapshotnamespace string
+	snapshotfile      string
+	snapshotformat    string
+	adminon           bool
+	adminaddr         string
+	admintoken        string
+	adminmaxbodymb    uint
+
+	deadlettertype  string
+	deadlettertopic string
+	deadletterfile  string
+
+	latetype  string
+	latetopic string
+	latefile  string
 }
 
 func from_args() opt {
 
 	var opt opt
 
+	flag.StringVar(&opt.sourcetype, "source_type", "pulsar", "Source of messages: pulsar - file")
+	flag.StringVar(&opt.sourcefile, "source_file", "-", "Path of the JSONL file for the file source (- for stdin)")
+	flag.StringVar(&opt.sourcefileformat, "source_file_format", "envelope", "Format of each line of the file source: raw (payload only) - envelope ({publish_time, event_time, properties, payload})")
+
 	flag.StringVar(&opt.sourcepulsar, "source_pulsar", "pulsar://localhost:6650", "Source pulsar address")
 	flag.StringVar(&opt.sourcetopic, "source_topic", "persistent://public/default/in", "Source topic names (seperated by ;)")
 	flag.StringVar(&opt.sourcesubscription, "source_subscription", "streaming_monitors", "Source subscription name")
+	flag.StringVar(&opt.sourcesubscriptiontype, "source_subscription_type", "exclusive", "Source subscription type: exclusive - failover - key_shared (scale out over instances, the topic must be keyed by id, see the route command)")
+	flag.StringVar(&opt.sourcestart, "source_start", "latest", "Seek the source subscription on start: latest (keep the subscription position) - earliest - RFC3339 time - message id ledger:entry[:partition[:batch]]; monitors are suppressed until the backlog is consumed")
 	flag.StringVar(&opt.sourcename, "source_name", "streaming_monitors_consumer", "Source consumer name")
 	flag.StringVar(&opt.sourcetrustcerts, "source_trust_certs", "", "Path for source pem file, for ca.cert")
 	flag.StringVar(&opt.sourcecertfile, "source_cert_file", "", "Path for source cert.pem file")
 	flag.StringVar(&opt.sourcekeyfile, "source_key_file", "", "Path for source key-pk8.pem file")
 	flag.BoolVar(&opt.sourceallowinsecureconnection, "source_allow_insecure_connection", false, "Source allow insecure connection")
 
+	flag.StringVar(&opt.desttype, "dest_type", "pulsar", "Destination of monitors: pulsar - file")
+	flag.StringVar(&opt.destfile, "dest_file", "-", "Path of the JSONL file for the file destination (- for stdout)")
+
 	flag.StringVar(&opt.destpulsar, "dest_pulsar", "pulsar://localhost:6650", "Destination pulsar address")
 	flag.StringVar(&opt.desttopic, "dest_topic", "persistent://public/default/out", "Destination topic name")
 	flag.StringVar(&opt.destsubscription, "dest_subscription", "streaming_monitors", "Destination subscription name")
@@ -84,9 +142,49 @@ func from_args() opt {
 
 	flag.StringVar(&opt.loglevel, "log_level", "info", "Logging level: panic - fatal - error - warn - info - debug - trace")
 
-	flag.UintVar(&opt.tickerseconds, "ticker_seconds", 1, "tickerseconds")
+	flag.UintVar(&opt.tickerseconds, "ticker_seconds", 1, "Max seconds between ticks of the stores (shorter for a namespace with a smaller granularity, down to 10ms)")
+	flag.UintVar(&opt.watermarkidleseconds, "watermark_idle_seconds", 10, "Seconds without messages after which a topic partition stops holding back the watermark (0 never)")
+
+	flag.UintVar(&opt.checkpointintervalms, "checkpoint_interval_ms", 0, "Milliseconds between checkpoints, messages are only acked after the persistent stores are synced (0 acks right after processing)")
+	flag.BoolVar(&opt.checkpointcumulative, "checkpoint_cumulative", false, "Ack cumulatively on checkpoint (requires consumer_threads 1 and an exclusive/failover subscription)")
+
+	flag.UintVar(&opt.shutdowntimeoutseconds, "shutdown_timeout_seconds", 30, "Seconds to drain, flush and checkpoint on SIGTERM/SIGINT before exiting anyway")
+
+	flag.UintVar(&opt.reloadpollseconds, "reload_poll_seconds", 0, "Seconds between checks of monitors_dir for changes to reload (0 only reloads on SIGHUP)")
+
+	flag.StringVar(&opt.deadlettertype, "dead_letter_type", "none", "Destination of the messages that fail processing (with the reason): none (only counted) - pulsar (dest_pulsar) - file")
+	flag.StringVar(&opt.deadlettertopic, "dead_letter_topic", "persistent://public/default/dead-letters", "Dead letter topic name (on dest_pulsar)")
+	flag.StringVar(&opt.deadletterfile, "dead_letter_file", "./dead_letters.jsonl", "Path of the JSONL file for the dead letters (- for stdout)")
+
+	flag.StringVar(&opt.latetype, "late_type", "none", "Destination of the metrics dropped for being late: none (only counted) - pulsar (dest_pulsar) - file")
+	flag.StringVar(&opt.latetopic, "late_topic", "persistent://public/default/late-metrics", "Late metrics topic name (on dest_pulsar)")
+	flag.StringVar(&opt.latefile, "late_file", "./late_metrics.jsonl", "Path of the JSONL file for the late metrics (- for stdout)")
+
+	flag.UintVar(&opt.jqtimeoutms, "jq_timeout_ms", 0, "Milliseconds each run of a jq program (groups, key, filter, lambda, monitor) may take, namespaces override it with jq_timeout (0 no limit)")
+
+	flag.StringVar(&opt.pebbledir, "pebble_dir", "persistent_data", "Data directory of the cached_pebble_store namespaces (one per instance)")
+	flag.StringVar(&opt.pebblewaldir, "pebble_wal_dir", "", "Directory of the pebble write-ahead log (empty is pebble_dir)")
+	flag.BoolVar(&opt.pebbledisablewal, "pebble_disable_wal", false, "Disable the pebble write-ahead log, the writes since the last flush are lost on a crash (checkpoints flush instead, namespaces with synced_writes are rejected)")
+	flag.UintVar(&opt.pebblecachemb, "pebble_cache_mb", 0, "Pebble block cache in MB (0 pebble default)")
+	flag.UintVar(&opt.pebblesyncintervalms, "pebble_sync_interval_ms", 0, "Milliseconds between background syncs of the pebble write-ahead log (flushes without it), 0 only on checkpoints and shutdown")
+
+	flag.StringVar(&opt.snapshotnamespace, "snapshot_namespace", "", "Namespace of the export/import commands")
+	flag.StringVar(&opt.snapshotfile, "snapshot_file", "-", "File written by export and read by import (- for stdout/stdin)")
+	flag.StringVar(&opt.snapshotformat, "snapshot_format", "", "Format of snapshot_file: json - cbor (empty by the extension, .cbor or json)")
+	flag.BoolVar(&opt.adminon, "admin_on", false, "Serve /admin/snapshot (export/import of a namespace state) on admin_addr")
+	flag.StringVar(&opt.adminaddr, "admin_addr", "localhost:7701", "Listen address of /admin/snapshot (localhost only by default)")
+	flag.StringVar(&opt.admintoken, "admin_token", "", "Token required in the Authorization: Bearer header of /admin/snapshot (empty none)")
+	flag.UintVar(&opt.adminmaxbodymb, "admin_max_body_mb", 64, "Max size in MB of a snapshot imported through /admin/snapshot")
+
+	flag.BoolVar(&opt.validatestrict, "validate_strict", false, "validate command fails on warnings")
 
-	flag.Parse()
+	// first argument (if not a flag) is the command: run (default) - route - replay - test - validate - export - import
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		opt.command = args[0]
+		args = args[1:]
+	}
+	flag.CommandLine.Parse(args)
 
 	return opt
 
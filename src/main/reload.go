@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"io/fs"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"example.com/streaming-metrics/src/flow"
+	"example.com/streaming-metrics/src/prom_metrics"
+)
+
+/*
+ * Reloads monitors_dir on SIGHUP or when its files change (polled every poll_interval, 0 disables)
+ * (on_reload is called with every pipeline published)
+ */
+func reload_on_changes(ctx context.Context, monitors_dir string, poll_interval time.Duration, pipeline *atomic.Pointer[flow.Pipeline], tickers *flow.Alarm_tickers, on_reload func(loaded *flow.Pipeline)) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var poll <-chan time.Time
+	if poll_interval > 0 {
+		ticker := time.NewTicker(poll_interval)
+		defer ticker.Stop()
+		poll = ticker.C
+	}
+
+	fingerprint := monitors_dir_fingerprint(monitors_dir)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-hup:
+			logrus.Infof("reload %s: SIGHUP", monitors_dir)
+
+		case <-poll:
+			current := monitors_dir_fingerprint(monitors_dir)
+			if current == fingerprint {
+				continue
+			}
+			logrus.Infof("reload %s: files changed", monitors_dir)
+		}
+
+		fingerprint = monitors_dir_fingerprint(monitors_dir)
+		if reload(monitors_dir, pipeline, tickers) {
+			on_reload(pipeline.Load())
+		}
+	}
+}
+
+/*
+ * Swaps the pipeline if monitors_dir is valid, the stores of unchanged namespaces are kept
+ */
+func reload(monitors_dir string, pipeline *atomic.Pointer[flow.Pipeline], tickers *flow.Alarm_tickers) (ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			logrus.Errorf("reload %s failed, keeping current monitors: %+v", monitors_dir, r)
+			ok = false
+		}
+	}()
+
+	if report := validate_monitors_dir(monitors_dir); !report.Ok {
+		for _, issue := range report.Errors {
+			logrus.Errorf("reload %s: %s %s %s", monitors_dir, issue.Kind, issue.Path, issue.Message)
+		}
+		logrus.Errorf("reload %s: invalid monitors, keeping current monitors", monitors_dir)
+		return false
+	}
+
+	previous := pipeline.Load().Namespaces
+	loaded, err := load_pipeline(monitors_dir, func(buf []byte) *flow.Namespace {
+		return flow.Reload_namespace(buf, previous)
+	})
+	if err != nil {
+		logrus.Errorf("reload %s: %+v, keeping current monitors", monitors_dir, err)
+		return false
+	}
+
+	loaded.Take_over_stores()
+	pipeline.Store(loaded)
+	tickers.Update(loaded.Namespaces)
+	prom_metrics.Prom_metric.Number_of_namespaces(len(loaded.Namespaces))
+
+	for name := range previous {
+		if _, ok := loaded.Namespaces[name]; !ok {
+			logrus.Infof("reload %s: removed namespace %s", monitors_dir, name)
+		}
+	}
+	for name := range loaded.Namespaces {
+		if _, ok := previous[name]; !ok {
+			logrus.Infof("reload %s: added namespace %s", monitors_dir, name)
+		}
+	}
+	logrus.Infof("reload %s: %d namespaces", monitors_dir, len(loaded.Namespaces))
+
+	return true
+}
+
+// hash of the path, size and modification time of every file
+func monitors_dir_fingerprint(monitors_dir string) uint64 {
+	hash := fnv.New64a()
+	filepath.WalkDir(monitors_dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+		fmt.Fprintf(hash, "%s %d %d\n", path, info.Size(), info.ModTime().UnixNano())
+		return nil
+	})
+	return hash.Sum64()
+}
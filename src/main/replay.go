@@ -0,0 +1,35 @@
+package main
+
+import (
+	"github.com/sirupsen/logrus"
+
+	"example.com/streaming-metrics/src/flow"
+	"example.com/streaming-metrics/src/prom_metrics"
+)
+
+/*
+ * replay - runs the monitors over a recorded file (-source_file) in event time
+ * and writes the alarms to -dest_file
+ */
+func replay(opt opt) {
+	prom_metrics.Setup_prometheus(0, false)
+
+	source, err := flow.New_file_source(opt.sourcefile, opt.sourcefileformat)
+	if err != nil {
+		logrus.Fatalln("Failed create file source. Reason: ", err)
+	}
+	defer source.Close()
+
+	sink, err := flow.New_file_sink(opt.destfile)
+	if err != nil {
+		logrus.Fatalln("Failed create file sink. Reason: ", err)
+	}
+	defer sink.Close()
+
+	pipeline, err := load_pipeline(opt.monitorsdir, flow.New_offline_namespace)
+	if err != nil {
+		logrus.Fatalln("Failed load monitors. Reason: ", err)
+	}
+
+	flow.New_replay(pipeline.Namespaces, pipeline.Filters, sink).Run(source)
+}
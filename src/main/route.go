@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+
+	"example.com/streaming-metrics/src/flow"
+	"example.com/streaming-metrics/src/prom_metrics"
+)
+
+/*
+ * route - republishes the source to the destination keyed by monitors_dir/groups/key.jq
+ * (the run instances then consume the destination on a key_shared subscription)
+ */
+func route(opt opt) {
+	prom_metrics.Setup_prometheus(opt.prometheusport, opt.activate_observe_processing_time)
+
+	key_file := filepath.Join(opt.monitorsdir, "groups", "key.jq")
+	key, err := compile_jq(key_file, group_filter_options()...)
+	if err != nil {
+		logrus.Fatalln("Failed load key program. Reason: ", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	source := new_source(opt)
+	sink := new_sink(opt)
+	dead_letters := new_dead_letters(opt)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		flow.New_router(key, sink, dead_letters).Run(source)
+	}()
+
+	select {
+	case <-ctx.Done():
+		source.Stop()
+		<-done
+	case <-done:
+	}
+
+	if err := sink.Flush(); err != nil {
+		logrus.Errorf("route: sink flush: %+v", err)
+	}
+	dead_letters.Close()
+	sink.Close()
+	source.Close()
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"example.com/streaming-metrics/src/flow"
+	"example.com/streaming-metrics/src/store/memory_store"
+)
+
+type workers struct {
+	source       flow.Source
+	sink         flow.Sink
+	dead_letters *flow.Dead_letters
+	late_metrics *flow.Late_metrics
+
+	monitor_ticker_chan chan *flow.Monitor_tick
+	write_chan          chan *flow.Write_struct
+	ack_chan            chan flow.Message
+
+	tick    *time.Ticker
+	tickers *flow.Alarm_tickers
+
+	consumers      sync.WaitGroup
+	alarms         sync.WaitGroup
+	reloader       sync.WaitGroup
+	acks_done      chan struct{}
+	watermark_stop chan struct{}
+	watermark_done chan struct{}
+	producer_done  chan struct{}
+}
+
+/*
+ * Orderly shutdown, returns false if it did not finish before the deadline
+ *
+ *	stop consuming -> consumers drain -> acks
+ *	stop tickers -> alarms drain -> producer drains -> sink flush
+ *	pebble synced and closed
+ */
+func (w *workers) shutdown(deadline time.Duration) bool {
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		w.reloader.Wait()
+
+		w.source.Stop()
+		w.consumers.Wait()
+		w.dead_letters.Close()
+		w.late_metrics.Close()
+		w.tick.Stop()
+		close(w.watermark_stop)
+		<-w.watermark_done
+		close(w.ack_chan)
+		<-w.acks_done
+		logrus.Infof("shutdown: consumers drained")
+
+		w.tickers.Stop()
+		close(w.monitor_ticker_chan)
+		w.alarms.Wait()
+		close(w.write_chan)
+		<-w.producer_done
+		if err := w.sink.Flush(); err != nil {
+			logrus.Errorf("shutdown: sink flush: %+v", err)
+		}
+		logrus.Infof("shutdown: monitors drained")
+
+		if err := memory_store.Close_persistence(); err != nil {
+			logrus.Errorf("shutdown: %+v", err)
+		}
+
+		w.sink.Close()
+		w.source.Close()
+	}()
+
+	select {
+	case <-done:
+		logrus.Infof("shutdown: done")
+		return true
+	case <-time.After(deadline):
+		logrus.Errorf("shutdown: deadline of %v exceeded", deadline)
+		return false
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+
+	"example.com/streaming-metrics/src/flow"
+	"example.com/streaming-metrics/src/prom_metrics"
+	"example.com/streaming-metrics/src/store"
+	"example.com/streaming-metrics/src/store/memory_store"
+)
+
+/*
+ * export - writes the store state of -snapshot_namespace to -snapshot_file
+ * import - replaces it with -snapshot_file
+ *
+ *	offline on the pebble_dir of a stopped instance (pebble is locked while it runs),
+ *	memory_store namespaces only have a state in a running instance: see admin_snapshot
+ *
+ *	export opens pebble read-only and the state as persisted (not migrated to the config)
+ */
+func export_snapshot(opt opt) {
+	prom_metrics.Setup_prometheus(0, false)
+
+	buf, config := find_snapshot_config(opt)
+	defer close_snapshot_persistence()
+
+	var snapshot *store.Snapshot
+	if config.Store_type == "cached_pebble_store" {
+		persisted, err := memory_store.Export_persisted(config.Namespace)
+		if err != nil {
+			logrus.Fatalf("export %s: %+v", opt.snapshotnamespace, err)
+		}
+		snapshot = persisted
+	} else {
+		snapshot = load_snapshot_namespace(opt, buf).Export_snapshot()
+	}
+
+	buf, err := store.Encode_snapshot(snapshot, snapshot_format(opt))
+	if err != nil {
+		logrus.Fatalf("export %s: %+v", opt.snapshotnamespace, err)
+	}
+
+	if opt.snapshotfile == "-" {
+		_, err = os.Stdout.Write(buf)
+	} else {
+		err = os.WriteFile(opt.snapshotfile, buf, 0644)
+	}
+	if err != nil {
+		logrus.Fatalf("export %s: %+v", opt.snapshotnamespace, err)
+	}
+	logrus.Infof("export %s: written to %s", opt.snapshotnamespace, opt.snapshotfile)
+}
+
+func import_snapshot(opt opt) {
+	prom_metrics.Setup_prometheus(0, false)
+
+	var buf []byte
+	var err error
+	if opt.snapshotfile == "-" {
+		buf, err = io.ReadAll(os.Stdin)
+	} else {
+		buf, err = os.ReadFile(opt.snapshotfile)
+	}
+	if err != nil {
+		logrus.Fatalf("import %s: %+v", opt.snapshotnamespace, err)
+	}
+	snapshot, err := store.Decode_snapshot(buf, snapshot_format(opt))
+	if err == nil {
+		err = snapshot.Validate()
+	}
+	if err != nil {
+		logrus.Fatalf("import %s: %+v", opt.snapshotnamespace, err)
+	}
+
+	config_buf, _ := find_snapshot_config(opt)
+	namespace := load_snapshot_namespace(opt, config_buf)
+	defer close_snapshot_persistence()
+
+	if err := namespace.Import_snapshot(snapshot); err != nil {
+		logrus.Fatalf("import %s: %+v", opt.snapshotnamespace, err)
+	}
+	logrus.Infof("import %s: %d windows imported from %s", opt.snapshotnamespace, len(snapshot.Windows), opt.snapshotfile)
+}
+
+// config file of -snapshot_namespace (and the config read from it)
+func find_snapshot_config(opt opt) ([]byte, *flow.Namespace) {
+	files, err := os.ReadDir(opt.monitorsdir + "/configs/")
+	if err != nil {
+		logrus.Fatalf("snapshot: %+v", err)
+	}
+
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		buf, err := os.ReadFile(opt.monitorsdir + "/configs/" + file.Name())
+		if err != nil {
+			continue
+		}
+		if config, _ := flow.Check_namespace_config(buf); config != nil && config.Namespace == opt.snapshotnamespace {
+			return buf, config
+		}
+	}
+
+	logrus.Fatalf("snapshot: namespace %s not found in %s/configs", opt.snapshotnamespace, opt.monitorsdir)
+	return nil, nil
+}
+
+// only the store of the namespace is opened (no other namespace is loaded or migrated)
+func load_snapshot_namespace(opt opt, buf []byte) *flow.Namespace {
+	namespace := flow.New_namesapce(buf)
+	if namespace == nil {
+		logrus.Fatalf("snapshot: unable to create namespace %s", opt.snapshotnamespace)
+	}
+	if namespace.Store_type == "memory_store" {
+		logrus.Warnf("snapshot %s: memory_store namespaces have no state outside a running instance (use /admin/snapshot)", opt.snapshotnamespace)
+	}
+	return namespace
+}
+
+func close_snapshot_persistence() {
+	if err := memory_store.Close_persistence(); err != nil {
+		logrus.Errorf("snapshot: %+v", err)
+	}
+}
+
+func snapshot_format(opt opt) string {
+	if opt.snapshotformat != "" {
+		return opt.snapshotformat
+	}
+	return store.Snapshot_format(opt.snapshotfile)
+}
+
+/*
+ * Serves /admin/snapshot on -admin_addr, apart from the prometheus port (localhost by default)
+ */
+func serve_admin(opt opt, pipeline *atomic.Pointer[flow.Pipeline]) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/snapshot", admin_snapshot(pipeline, opt.admintoken, int64(opt.adminmaxbodymb)<<20))
+
+	logrus.Infof("admin exposed at: %s/admin/snapshot (token %t)", opt.adminaddr, opt.admintoken != "")
+	go func() {
+		if err := http.ListenAndServe(opt.adminaddr, mux); err != nil {
+			logrus.Errorf("serve admin: %+v", err)
+		}
+	}()
+}
+
+/*
+ * /admin/snapshot?namespace=<namespace>&format=json|cbor (-admin_on)
+ *
+ *	GET - the store state of the namespace
+ *	PUT/POST - replaces it with the body (at most max_body bytes)
+ *
+ *	with a token every request needs "Authorization: Bearer <token>"
+ */
+func admin_snapshot(pipeline *atomic.Pointer[flow.Pipeline], token string, max_body int64) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		name := r.URL.Query().Get("namespace")
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = "json"
+		}
+
+		namespace, ok := pipeline.Load().Namespaces[name]
+		if !ok {
+			http.Error(w, fmt.Sprintf("namespace %s not loaded", name), http.StatusNotFound)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			buf, err := store.Encode_snapshot(namespace.Export_snapshot(), format)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if format == "cbor" {
+				w.Header().Set("Content-Type", "application/cbor")
+			} else {
+				w.Header().Set("Content-Type", "application/json")
+			}
+			w.Write(buf)
+
+		case http.MethodPut, http.MethodPost:
+			buf, err := io.ReadAll(http.MaxBytesReader(w, r.Body, max_body))
+			var too_large *http.MaxBytesError
+			if errors.As(err, &too_large) {
+				http.Error(w, fmt.Sprintf("snapshot larger than %d bytes (-admin_max_body_mb)", max_body), http.StatusRequestEntityTooLarge)
+				return
+			} else if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			snapshot, err := store.Decode_snapshot(buf, format)
+			if err == nil {
+				err = snapshot.Validate()
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := namespace.Import_snapshot(snapshot); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			logrus.Infof("admin: %d windows imported into %s", len(snapshot.Windows), name)
+			w.WriteHeader(http.StatusNoContent)
+
+		default:
+			http.Error(w, "GET - PUT - POST", http.StatusMethodNotAllowed)
+		}
+	}
+}
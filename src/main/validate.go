@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/itchyny/gojq"
+	"github.com/sirupsen/logrus"
+
+	"example.com/streaming-metrics/src/flow"
+)
+
+type validation_issue struct {
+	Severity  string `json:"severity"`
+	Kind      string `json:"kind"`
+	Path      string `json:"path,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+	Group     string `json:"group,omitempty"`
+	Message   string `json:"message"`
+}
+
+type validation_report struct {
+	Ok         bool               `json:"ok"`
+	Namespaces int                `json:"namespaces"`
+	Errors     []validation_issue `json:"errors"`
+	Warnings   []validation_issue `json:"warnings"`
+}
+
+func (report *validation_report) error(issue validation_issue) {
+	issue.Severity = "error"
+	report.Errors = append(report.Errors, issue)
+}
+
+func (report *validation_report) warning(issue validation_issue) {
+	issue.Severity = "warning"
+	report.Warnings = append(report.Warnings, issue)
+}
+
+/*
+ * validate - checks a monitors directory without opening any store,
+ * prints a json report and exits with 1 on errors (or warnings if -validate_strict)
+ */
+func validate(opt opt) {
+	report := validate_monitors_dir(opt.monitorsdir)
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		logrus.Fatalf("validate encode report: %+v", err)
+	}
+
+	if !report.Ok || (opt.validatestrict && len(report.Warnings) > 0) {
+		os.Exit(1)
+	}
+}
+
+func validate_monitors_dir(monitors_dir string) *validation_report {
+	report := &validation_report{
+		Errors:   make([]validation_issue, 0),
+		Warnings: make([]validation_issue, 0),
+	}
+
+	configs_dir := filepath.Join(monitors_dir, "configs")
+	files, err := os.ReadDir(configs_dir)
+	if err != nil {
+		report.error(validation_issue{Kind: "configs", Path: configs_dir, Message: err.Error()})
+	}
+
+	// namespace -> group of the valid configs
+	namespace_groups := make(map[string]string)
+	config_files := make(map[string]string)
+
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		path := filepath.Join(configs_dir, file.Name())
+
+		buf, err := os.ReadFile(path)
+		if err != nil {
+			report.error(validation_issue{Kind: "config", Path: path, Message: err.Error()})
+			continue
+		}
+
+		namespace, problems := flow.Check_namespace_config(buf)
+		for _, problem := range problems {
+			issue := validation_issue{Kind: "config", Path: path, Message: problem}
+			if namespace != nil {
+				issue.Namespace = namespace.Namespace
+			}
+			report.error(issue)
+		}
+		if namespace == nil || len(problems) > 0 {
+			continue
+		}
+
+		if other, ok := config_files[namespace.Namespace]; ok {
+			report.error(validation_issue{Kind: "config", Path: path, Namespace: namespace.Namespace, Message: fmt.Sprintf("namespace already defined in %s", other)})
+			continue
+		}
+		config_files[namespace.Namespace] = path
+		namespace_groups[namespace.Namespace] = namespace.Group
+
+		validate_namespace_programs(report, monitors_dir, namespace)
+	}
+
+	validate_groups(report, monitors_dir, namespace_groups)
+	validate_route_key(report, monitors_dir)
+	validate_orphaned_dirs(report, monitors_dir, namespace_groups)
+
+	report.Namespaces = len(namespace_groups)
+	report.Ok = len(report.Errors) == 0
+	return report
+}
+
+func validate_namespace_programs(report *validation_report, monitors_dir string, namespace *flow.Namespace) {
+	programs := []struct {
+		name    string
+		options []gojq.CompilerOption
+	}{
+		{"filter.jq", filter_options()},
+		{"lambda.jq", lambda_options()},
+		{"monitor.jq", monitor_options()},
+	}
+
+	for _, program := range programs {
+		path := filepath.Join(monitors_dir, namespace.Namespace, program.name)
+		if _, err := compile_jq(path, program.options...); err != nil {
+			report.error(validation_issue{Kind: "jq", Path: path, Namespace: namespace.Namespace, Group: namespace.Group, Message: err.Error()})
+		}
+	}
+
+	// optional
+	path := filepath.Join(monitors_dir, namespace.Namespace, "on_bucket_close.jq")
+	if _, err := os.Stat(path); err == nil {
+		if _, err := compile_jq(path, monitor_options()...); err != nil {
+			report.error(validation_issue{Kind: "jq", Path: path, Namespace: namespace.Namespace, Group: namespace.Group, Message: err.Error()})
+		}
+	}
+}
+
+func validate_groups(report *validation_report, monitors_dir string, namespace_groups map[string]string) {
+	path := filepath.Join(monitors_dir, "groups", "groups.jq")
+
+	if _, err := compile_jq(path, group_filter_options()...); err != nil {
+		report.error(validation_issue{Kind: "jq", Path: path, Message: err.Error()})
+		return
+	}
+
+	program, _ := parse_jq(path)
+	groups := make(map[string]bool)
+	if dynamic := output_literals(program, groups); dynamic {
+		report.warning(validation_issue{Kind: "groups", Path: path, Message: "groups.jq returns computed values, unable to check group reachability"})
+		return
+	}
+
+	used_groups := make(map[string]bool)
+	for _, namespace := range sorted_keys(namespace_groups) {
+		group := namespace_groups[namespace]
+		used_groups[group] = true
+		if !groups[group] {
+			report.warning(validation_issue{Kind: "unreachable_group", Path: path, Namespace: namespace, Group: group, Message: "group is never returned by groups.jq, namespace never receives data"})
+		}
+	}
+
+	for _, group := range sorted_keys(groups) {
+		if !used_groups[group] {
+			report.warning(validation_issue{Kind: "orphaned_group", Path: path, Group: group, Message: "group returned by groups.jq has no namespace, its messages are dropped"})
+		}
+	}
+}
+
+// groups/key.jq is optional (only used by the route command)
+func validate_route_key(report *validation_report, monitors_dir string) {
+	path := filepath.Join(monitors_dir, "groups", "key.jq")
+	if _, err := os.Stat(path); err != nil {
+		return
+	}
+
+	if _, err := compile_jq(path, group_filter_options()...); err != nil {
+		report.error(validation_issue{Kind: "jq", Path: path, Message: err.Error()})
+	}
+}
+
+func validate_orphaned_dirs(report *validation_report, monitors_dir string, namespace_groups map[string]string) {
+	dirs, err := os.ReadDir(monitors_dir)
+	if err != nil {
+		report.error(validation_issue{Kind: "monitors_dir", Path: monitors_dir, Message: err.Error()})
+		return
+	}
+
+	for _, dir := range dirs {
+		if !dir.IsDir() || dir.Name() == "configs" || dir.Name() == "groups" {
+			continue
+		}
+		if _, ok := namespace_groups[dir.Name()]; !ok {
+			report.warning(validation_issue{Kind: "orphaned_namespace", Path: filepath.Join(monitors_dir, dir.Name()), Namespace: dir.Name(), Message: "directory without a valid config, it is never loaded"})
+		}
+	}
+}
+
+/*
+ * Collects the string literals a program can output.
+ * Returns true if some output can not be determined statically.
+ */
+func output_literals(query *gojq.Query, literals map[string]bool) (dynamic bool) {
+	if query == nil {
+		return false
+	}
+
+	if query.Term == nil {
+		switch query.Op {
+		case gojq.OpPipe:
+			return output_literals(query.Right, literals)
+		case gojq.OpComma, gojq.OpAlt:
+			left := output_literals(query.Left, literals)
+			right := output_literals(query.Right, literals)
+			return left || right
+		default:
+			return true
+		}
+	}
+
+	term := query.Term
+	for _, suffix := range term.SuffixList {
+		if suffix.Bind != nil {
+			return output_literals(suffix.Bind.Body, literals)
+		}
+	}
+	if len(term.SuffixList) > 0 {
+		return true
+	}
+
+	switch {
+	case term.Str != nil:
+		if term.Str.Queries != nil {
+			return true
+		}
+		literals[term.Str.Str] = true
+		return false
+	case term.Query != nil:
+		return output_literals(term.Query, literals)
+	case term.If != nil:
+		dynamic := output_literals(term.If.Then, literals)
+		for _, elif := range term.If.Elif {
+			dynamic = output_literals(elif.Then, literals) || dynamic
+		}
+		return output_literals(term.If.Else, literals) || dynamic
+	case term.Try != nil:
+		body := output_literals(term.Try.Body, literals)
+		return output_literals(term.Try.Catch, literals) || body
+	case term.Label != nil:
+		return output_literals(term.Label.Body, literals)
+	case term.Func != nil:
+		switch term.Func.Name {
+		case "filter_error", "error", "empty", "null", "true", "false":
+			return false
+		default:
+			return true
+		}
+	case term.Type == gojq.TermTypeNull || term.Type == gojq.TermTypeTrue || term.Type == gojq.TermTypeFalse ||
+		term.Type == gojq.TermTypeNumber || term.Type == gojq.TermTypeObject || term.Type == gojq.TermTypeArray ||
+		term.Type == gojq.TermTypeBreak:
+		return false
+	default:
+		return true
+	}
+}
+
+func sorted_keys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -12,7 +12,7 @@ import (
 )
 
 type Prom_metrics struct {
-	namespace_count           prometheus.Counter
+	namespace_count           prometheus.Gauge
 	pulsar_processed_msg      prometheus.Counter
 	pulsar_processed_msg_time prometheus.Summary
 	filter_time               prometheus.Summary
@@ -21,15 +21,43 @@ type Prom_metrics struct {
 	push_time                prometheus.Summary
 	monitors_ticks_generated *prometheus.CounterVec
 	monitors_sent            *prometheus.CounterVec
+	checkpoints              *prometheus.CounterVec
+	dead_letters             *prometheus.CounterVec
+	routed_msg               prometheus.Counter
+	monitors_suppressed      *prometheus.CounterVec
+	monitors_missed          *prometheus.CounterVec
+	monitors_skipped         *prometheus.CounterVec
+	backfill                 prometheus.Gauge
+	time_parse_failures      *prometheus.CounterVec
+	late_metrics             *prometheus.CounterVec
+	future_metrics           *prometheus.CounterVec
+	watermark                prometheus.Gauge
+	watermark_partitions     *prometheus.GaugeVec
+	jq_timeouts              *prometheus.CounterVec
+	quarantined              *prometheus.GaugeVec
 
 	Number_of_namespaces              func(n int)
 	Inc_number_processed_msg          func()
+	Add_number_processed_msg          func(n int)
 	Observe_processing_time           func(t time.Duration)
 	Observe_filter_time               func(t time.Duration)
 	Inc_namespace_number_filtered_msg func(namespace string)
 	Observe_push_time                 func(t time.Duration)
 	Inc_monitors_ticks                func(namespace string)
 	Inc_monitors_sent                 func(namespace string, pulsar_event string)
+	Inc_checkpoints                   func(status string)
+	Inc_dead_letters                  func(reason string)
+	Inc_routed_msg                    func()
+	Inc_monitors_suppressed           func(namespace string)
+	Add_monitors_missed               func(namespace string, n int)
+	Inc_monitors_skipped              func(namespace string, policy string)
+	Set_backfill                      func(active bool)
+	Inc_time_parse_failures           func(namespace string, reason string)
+	Inc_late_metrics                  func(namespace string, reason string)
+	Inc_future_metrics                func(namespace string, policy string)
+	Set_watermark                     func(watermark time.Time, active int, idle int)
+	Inc_jq_timeouts                   func(namespace string, program string)
+	Set_quarantined                   func(namespace string, quarantined bool)
 
 	activate_observe_processing_time bool
 }
@@ -55,14 +83,28 @@ func (prom_metric *Prom_metrics) registor(reg *prometheus.Registry) {
 	}
 	reg.MustRegister(prom_metric.monitors_ticks_generated)
 	reg.MustRegister(prom_metric.monitors_sent)
+	reg.MustRegister(prom_metric.checkpoints)
+	reg.MustRegister(prom_metric.dead_letters)
+	reg.MustRegister(prom_metric.routed_msg)
+	reg.MustRegister(prom_metric.monitors_suppressed)
+	reg.MustRegister(prom_metric.monitors_missed)
+	reg.MustRegister(prom_metric.monitors_skipped)
+	reg.MustRegister(prom_metric.backfill)
+	reg.MustRegister(prom_metric.time_parse_failures)
+	reg.MustRegister(prom_metric.late_metrics)
+	reg.MustRegister(prom_metric.future_metrics)
+	reg.MustRegister(prom_metric.watermark)
+	reg.MustRegister(prom_metric.watermark_partitions)
+	reg.MustRegister(prom_metric.jq_timeouts)
+	reg.MustRegister(prom_metric.quarantined)
 }
 
 func create_prom_metric(activate_observe_processing_time bool) *Prom_metrics {
 	prom_metric := &Prom_metrics{
 		activate_observe_processing_time: activate_observe_processing_time,
 
-		namespace_count: prometheus.NewCounter(
-			prometheus.CounterOpts{
+		namespace_count: prometheus.NewGauge(
+			prometheus.GaugeOpts{
 				Name: "namespace_count",
 				Help: "The total number of namespaces",
 			},
@@ -112,16 +154,104 @@ func create_prom_metric(activate_observe_processing_time bool) *Prom_metrics {
 				Help: "The number of monitors run and sent to pulsar",
 			}, []string{"namespace", "pulsar_event"},
 		),
+		checkpoints: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "checkpoints",
+				Help: "The number of checkpoints (synced commit of the stores followed by the acks)",
+			}, []string{"status"},
+		),
+		dead_letters: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "dead_letters",
+				Help: "The number of messages (or metrics) that could not be processed per reason",
+			}, []string{"reason"},
+		),
+		routed_msg: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "routed_msg",
+				Help: "The number of messages forwarded keyed by the route command",
+			},
+		),
+		monitors_suppressed: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "monitors_suppressed",
+				Help: "The number of monitor runs suppressed during the backfill per namespace",
+			}, []string{"namespace"},
+		),
+		monitors_missed: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "monitors_missed",
+				Help: "The number of scheduled monitor runs missed while the previous one could not be queued per namespace",
+			}, []string{"namespace"},
+		),
+		monitors_skipped: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "monitors_skipped",
+				Help: "The number of monitor runs skipped by the overlap_policy (skip - coalesce) per namespace",
+			}, []string{"namespace", "policy"},
+		),
+		backfill: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "backfill",
+				Help: "1 while the source is backfilling history (monitors suppressed)",
+			},
+		),
+		time_parse_failures: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "time_parse_failures",
+				Help: "The number of metrics dropped per namespace because their time is invalid or missing",
+			}, []string{"namespace", "reason"},
+		),
+		late_metrics: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "late_metrics",
+				Help: "The number of metrics dropped per namespace for arriving after allowed_lateness (late) or the window (expired)",
+			}, []string{"namespace", "reason"},
+		),
+		future_metrics: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "future_metrics",
+				Help: "The number of metrics per namespace ahead of max_future_skew (rejected or clamped)",
+			}, []string{"namespace", "policy"},
+		),
+		watermark: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "watermark",
+				Help: "The watermark the stores are ticked to (unix seconds)",
+			},
+		),
+		watermark_partitions: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "watermark_partitions",
+				Help: "The number of topic partitions holding the watermark (active) or ignored (idle)",
+			}, []string{"state"},
+		),
+		jq_timeouts: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "jq_timeouts",
+				Help: "The number of jq runs stopped for exceeding their time budget per namespace and program",
+			}, []string{"namespace", "program"},
+		),
+		quarantined: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "quarantined",
+				Help: "1 while the namespace is quarantined for exceeding its jq time budget repeatedly",
+			}, []string{"namespace"},
+		),
 	}
 
 	prom_metric.Number_of_namespaces = func(n int) {
-		prom_metric.namespace_count.Add(float64(n))
+		prom_metric.namespace_count.Set(float64(n))
 	}
 
 	prom_metric.Inc_number_processed_msg = func() {
 		prom_metric.pulsar_processed_msg.Inc()
 	}
 
+	prom_metric.Add_number_processed_msg = func(n int) {
+		prom_metric.pulsar_processed_msg.Add(float64(n))
+	}
+
 	if prom_metric.activate_observe_processing_time {
 		prom_metric.Observe_processing_time = func(t time.Duration) {
 			go prom_metric.pulsar_processed_msg_time.Observe(float64(t / time.Microsecond))
@@ -158,6 +288,68 @@ func create_prom_metric(activate_observe_processing_time bool) *Prom_metrics {
 		prom_metric.monitors_sent.With(prometheus.Labels{"namespace": namespace, "pulsar_event": pulsar_event}).Inc()
 	}
 
+	prom_metric.Inc_checkpoints = func(status string) {
+		prom_metric.checkpoints.With(prometheus.Labels{"status": status}).Inc()
+	}
+
+	prom_metric.Inc_dead_letters = func(reason string) {
+		prom_metric.dead_letters.With(prometheus.Labels{"reason": reason}).Inc()
+	}
+
+	prom_metric.Inc_routed_msg = func() {
+		prom_metric.routed_msg.Inc()
+	}
+
+	prom_metric.Inc_monitors_suppressed = func(namespace string) {
+		prom_metric.monitors_suppressed.With(prometheus.Labels{"namespace": namespace}).Inc()
+	}
+
+	prom_metric.Add_monitors_missed = func(namespace string, n int) {
+		prom_metric.monitors_missed.With(prometheus.Labels{"namespace": namespace}).Add(float64(n))
+	}
+
+	prom_metric.Inc_monitors_skipped = func(namespace string, policy string) {
+		prom_metric.monitors_skipped.With(prometheus.Labels{"namespace": namespace, "policy": policy}).Inc()
+	}
+
+	prom_metric.Set_backfill = func(active bool) {
+		if active {
+			prom_metric.backfill.Set(1)
+		} else {
+			prom_metric.backfill.Set(0)
+		}
+	}
+
+	prom_metric.Inc_time_parse_failures = func(namespace string, reason string) {
+		prom_metric.time_parse_failures.With(prometheus.Labels{"namespace": namespace, "reason": reason}).Inc()
+	}
+
+	prom_metric.Inc_late_metrics = func(namespace string, reason string) {
+		prom_metric.late_metrics.With(prometheus.Labels{"namespace": namespace, "reason": reason}).Inc()
+	}
+
+	prom_metric.Inc_future_metrics = func(namespace string, policy string) {
+		prom_metric.future_metrics.With(prometheus.Labels{"namespace": namespace, "policy": policy}).Inc()
+	}
+
+	prom_metric.Set_watermark = func(watermark time.Time, active int, idle int) {
+		prom_metric.watermark.Set(float64(watermark.UnixMilli()) / 1000)
+		prom_metric.watermark_partitions.With(prometheus.Labels{"state": "active"}).Set(float64(active))
+		prom_metric.watermark_partitions.With(prometheus.Labels{"state": "idle"}).Set(float64(idle))
+	}
+
+	prom_metric.Inc_jq_timeouts = func(namespace string, program string) {
+		prom_metric.jq_timeouts.With(prometheus.Labels{"namespace": namespace, "program": program}).Inc()
+	}
+
+	prom_metric.Set_quarantined = func(namespace string, quarantined bool) {
+		if quarantined {
+			prom_metric.quarantined.With(prometheus.Labels{"namespace": namespace}).Set(1)
+		} else {
+			prom_metric.quarantined.Delete(prometheus.Labels{"namespace": namespace})
+		}
+	}
+
 	return prom_metric
 }
 
@@ -182,8 +374,10 @@ func Setup_prometheus(prometheusport uint, activate_observe_processing_time bool
 		))
 
 		logrus.Infof("metrics exposed at: localhost:%d/metrics", prometheusport)
-		if err := http.ListenAndServe(fmt.Sprintf(":%d", prometheusport), nil); err != nil {
-			logrus.Errorf("setup prometheus: %+v", err)
-		}
+		go func() {
+			if err := http.ListenAndServe(fmt.Sprintf(":%d", prometheusport), nil); err != nil {
+				logrus.Errorf("setup prometheus: %+v", err)
+			}
+		}()
 	}
 }
@@ -1,6 +1,7 @@
 package memory_store
 
 import (
+	"context"
 	"encoding/json"
 
 	"github.com/itchyny/gojq"
@@ -12,11 +13,11 @@ type Bucket struct {
 	//mutex sync.Mutex
 }
 
-func (bucket *Bucket) push(metric any, lambda *gojq.Code) {
+func (bucket *Bucket) push(ctx context.Context, metric any, lambda *gojq.Code) {
 	// bucket.mutex.Lock()
 	// defer bucket.mutex.Unlock()
 
-	iter := lambda.Run(nil, bucket.State, metric)
+	iter := lambda.RunWithContext(ctx, nil, bucket.State, metric)
 	v, ok := iter.Next()
 	if !ok {
 		logrus.Errorf("Bucket.push: lambda function did not return new state")
@@ -0,0 +1,94 @@
+package memory_store
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	store_interface "example.com/streaming-metrics/src/store"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+/*
+ * State codecs - encoding of the window values persisted to pebble (bucket states and current bucket group)
+ *
+ *	cbor (default of a new namespace) - json
+ *
+ * The metadata keys are always json, <namespace>/meta/state_codec records the codec of the values
+ * (missing for data written before the codecs, which is json)
+ */
+
+const Default_state_codec = "cbor"
+
+type state_codec interface {
+	marshal(v any) ([]byte, error)
+	unmarshal(b []byte, v any) error
+}
+
+var state_codecs = map[string]state_codec{
+	"json": json_codec{},
+	"cbor": new_cbor_codec(),
+}
+
+// empty keeps the persisted codec
+func Valid_state_codec(name string) bool {
+	_, ok := state_codecs[name]
+	return ok || name == ""
+}
+
+func get_state_codec(name string) (state_codec, error) {
+	codec, ok := state_codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("%s is not a valid state_codec (cbor - json)", name)
+	}
+	return codec, nil
+}
+
+type json_codec struct{}
+
+func (json_codec) marshal(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// integers stay exact (above 2^53 too)
+func (json_codec) unmarshal(b []byte, v any) error {
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+	if err := decoder.Decode(v); err != nil {
+		return err
+	}
+	if decoder.More() {
+		return fmt.Errorf("data after the value")
+	}
+	if state, ok := v.(*any); ok {
+		var err error
+		*state, err = store_interface.From_json_numbers(*state)
+		return err
+	}
+	return nil
+}
+
+type cbor_codec struct {
+	encoding cbor.EncMode
+	decoding cbor.DecMode
+}
+
+// floats in the shortest lossless size, maps decoded as map[string]any (as json) for gojq, integers stay int64/uint64/*big.Int (normalized by gojq)
+func new_cbor_codec() cbor_codec {
+	encoding, _ := cbor.EncOptions{ShortestFloat: cbor.ShortestFloat16}.EncMode()
+	decoding, _ := cbor.DecOptions{
+		DefaultMapType: reflect.TypeOf(map[string]any(nil)),
+		BigIntDec:      cbor.BigIntDecodePointer,
+	}.DecMode()
+	return cbor_codec{encoding: encoding, decoding: decoding}
+}
+
+func (codec cbor_codec) marshal(v any) ([]byte, error) {
+	return codec.encoding.Marshal(v)
+}
+
+func (codec cbor_codec) unmarshal(b []byte, v any) error {
+	return codec.decoding.Unmarshal(b, v)
+}
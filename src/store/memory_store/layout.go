@@ -0,0 +1,263 @@
+package memory_store
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	store_interface "example.com/streaming-metrics/src/store"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/sirupsen/logrus"
+)
+
+/*
+ *	BD Keys
+ *
+ *	<namespace>/meta/granularity - cardinality - time_unit (not for seconds) - current_time - state_codec - generation
+ *	<namespace>/w/<id>/current - current bucket group of the window
+ *	<namespace>/w/<id>/<bucket> - state of the bucket (no key without a state)
+ *
+ *	the windows of generation 1 are under <namespace>/w1/ (generation 0, missing for older data, is w):
+ *	a rewrite (write_windows) stages the windows in the other generation and the metadata switches to it
+ *	in its last commit, so a crash during a rewrite keeps the previous windows
+ *
+ *	the window values are encoded by state_codec (see codec.go), the metadata is json
+ *	the id is path escaped (no "/"), so a window is one prefix: loaded by a range scan, deleted by a range delete
+ */
+
+type meta_keys struct {
+	granularity  []byte
+	cardinality  []byte
+	time_unit    []byte
+	current_time []byte
+	state_codec  []byte
+	generation   []byte
+}
+
+func new_meta_keys(namespace string) meta_keys {
+	return meta_keys{
+		granularity:  []byte(fmt.Sprintf("%s/meta/granularity", namespace)),
+		cardinality:  []byte(fmt.Sprintf("%s/meta/cardinality", namespace)),
+		time_unit:    []byte(fmt.Sprintf("%s/meta/time_unit", namespace)),
+		current_time: []byte(fmt.Sprintf("%s/meta/current_time", namespace)),
+		state_codec:  []byte(fmt.Sprintf("%s/meta/state_codec", namespace)),
+		generation:   []byte(fmt.Sprintf("%s/meta/generation", namespace)),
+	}
+}
+
+func windows_prefix(namespace string, generation int64) []byte {
+	if generation == 0 {
+		return []byte(fmt.Sprintf("%s/w/", namespace))
+	}
+	return []byte(fmt.Sprintf("%s/w%d/", namespace, generation))
+}
+
+func window_prefix(namespace string, generation int64, id string) []byte {
+	return append(windows_prefix(namespace, generation), url.PathEscape(id)+"/"...)
+}
+
+func current_bucket_group_key(namespace string, generation int64, id string) []byte {
+	return append(window_prefix(namespace, generation, id), "current"...)
+}
+
+func bucket_key(namespace string, generation int64, id string, index int) []byte {
+	return strconv.AppendInt(window_prefix(namespace, generation, id), int64(index), 10)
+}
+
+// first key after every key starting with prefix
+func prefix_end(prefix []byte) []byte {
+	end := append([]byte{}, prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// metadata of the persisted namespace (either layout)
+type persisted_metadata struct {
+	legacy       bool
+	granularity  int64
+	cardinality  int64
+	time_unit    string
+	current_time int64
+	codec_name   string
+	generation   int64
+}
+
+// found false if the namespace is not persisted
+func (store *Memory_store) read_metadata() (meta persisted_metadata, found bool, err error) {
+	keys := new_meta_keys(store.namespace)
+	err = store.get_value(keys.granularity, &meta.granularity)
+	if err == pebble.ErrNotFound {
+		keys, meta.legacy = new_legacy_meta_keys(store.namespace), true
+		err = store.get_value(keys.granularity, &meta.granularity)
+	}
+	if err == pebble.ErrNotFound {
+		return meta, false, nil
+	} else if err != nil {
+		return meta, false, fmt.Errorf("granularity: %w", err)
+	}
+
+	if err := store.get_value(keys.cardinality, &meta.cardinality); err != nil {
+		return meta, false, fmt.Errorf("cardinality: %w", err)
+	}
+	if meta.time_unit, err = store.load_time_unit(keys.time_unit); err != nil {
+		return meta, false, err
+	}
+	if err := store.get_value(keys.current_time, &meta.current_time); err != nil {
+		return meta, false, fmt.Errorf("current_time: %w", err)
+	}
+	if meta.codec_name, err = store.load_state_codec(keys.state_codec); err != nil {
+		return meta, false, err
+	}
+	if _, err := get_state_codec(meta.codec_name); err != nil {
+		return meta, false, err
+	}
+	if !meta.legacy {
+		if err := store.get_value(keys.generation, &meta.generation); err != nil && err != pebble.ErrNotFound {
+			return meta, false, fmt.Errorf("generation: %w", err)
+		}
+	}
+
+	return meta, true, nil
+}
+
+// windows at the granularity and cardinality of meta
+func (store *Memory_store) read_persisted_windows(meta persisted_metadata) (map[string]*store_interface.Window_snapshot, error) {
+	var windows map[string]*store_interface.Window_snapshot
+	var err error
+	if meta.legacy {
+		windows, err = store.read_legacy_windows(meta.cardinality)
+	} else {
+		windows, err = store.read_windows(meta.generation, meta.cardinality, state_codecs[meta.codec_name])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("windows: %w", err)
+	}
+	return windows, nil
+}
+
+/*
+ * Reads every window of generation in one range scan (cardinality and codec of the persisted layout)
+ */
+func (store *Memory_store) read_windows(generation int64, cardinality int64, codec state_codec) (map[string]*store_interface.Window_snapshot, error) {
+	prefix := windows_prefix(store.namespace, generation)
+	iter, err := store.db.NewIter(&pebble.IterOptions{LowerBound: prefix, UpperBound: prefix_end(prefix)})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	type persisted_window struct {
+		current int64
+		states  map[int64]any
+	}
+	persisted := make(map[string]*persisted_window)
+
+	for iter.First(); iter.Valid(); iter.Next() {
+		rest := string(iter.Key()[len(prefix):])
+		i := strings.LastIndexByte(rest, '/')
+		if i < 0 {
+			logrus.Warnf("memory_store read_windows %s: ignoring key %s", store.namespace, iter.Key())
+			continue
+		}
+		id, err := url.PathUnescape(rest[:i])
+		if err != nil {
+			logrus.Warnf("memory_store read_windows %s: ignoring key %s", store.namespace, iter.Key())
+			continue
+		}
+
+		window, ok := persisted[id]
+		if !ok {
+			window = &persisted_window{states: make(map[int64]any)}
+			persisted[id] = window
+		}
+
+		if suffix := rest[i+1:]; suffix == "current" {
+			if err := codec.unmarshal(iter.Value(), &window.current); err != nil {
+				return nil, fmt.Errorf("%s: %w", iter.Key(), err)
+			}
+		} else if index, err := strconv.ParseInt(suffix, 10, 64); err == nil {
+			var state any
+			if err := codec.unmarshal(iter.Value(), &state); err != nil {
+				return nil, fmt.Errorf("%s: %w", iter.Key(), err)
+			}
+			window.states[index] = state
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+
+	length := cardinality + 1
+	windows := make(map[string]*store_interface.Window_snapshot, len(persisted))
+	for id, window := range persisted {
+		snapshot := &store_interface.Window_snapshot{Current_bucket_group: window.current}
+		// the bucket group of each index, oldest first
+		for group := Max(window.current-length+1, 0); group <= window.current; group++ {
+			if state := window.states[group%length]; state != nil {
+				snapshot.Buckets = append(snapshot.Buckets, store_interface.Bucket_snapshot{Bucket_group: group, State: state})
+			}
+		}
+		windows[id] = snapshot
+	}
+
+	return windows, nil
+}
+
+/*
+ * Legacy layout (rewritten to the one above on load), json values
+ *
+ *	<namespace>/granularity - cardinality - time_unit - current_time - len_windows
+ *	<namespace>/window/<idx> - id of the window idx
+ *	<namespace>/<id>/current_bucket_group - <namespace>/<id>/<bucket>
+ */
+
+func new_legacy_meta_keys(namespace string) meta_keys {
+	return meta_keys{
+		granularity:  []byte(fmt.Sprintf("%s/granularity", namespace)),
+		cardinality:  []byte(fmt.Sprintf("%s/cardinality", namespace)),
+		time_unit:    []byte(fmt.Sprintf("%s/time_unit", namespace)),
+		current_time: []byte(fmt.Sprintf("%s/current_time", namespace)),
+	}
+}
+
+func (store *Memory_store) read_legacy_windows(cardinality int64) (map[string]*store_interface.Window_snapshot, error) {
+	var number_windows int
+	if err := store.get_value([]byte(fmt.Sprintf("%s/len_windows", store.namespace)), &number_windows); err != nil {
+		return nil, fmt.Errorf("len_windows: %w", err)
+	}
+
+	length := cardinality + 1
+	windows := make(map[string]*store_interface.Window_snapshot, number_windows)
+
+	for idx := 0; idx < number_windows; idx++ {
+		var id string
+		if err := store.get_value([]byte(fmt.Sprintf("%s/window/%d", store.namespace, idx)), &id); err != nil {
+			return nil, fmt.Errorf("window %d: %w", idx, err)
+		}
+		var current int64
+		if err := store.get_value([]byte(fmt.Sprintf("%s/%s/current_bucket_group", store.namespace, id)), &current); err != nil {
+			return nil, fmt.Errorf("%s current_bucket_group: %w", id, err)
+		}
+
+		window := &store_interface.Window_snapshot{Current_bucket_group: current}
+		for group := Max(current-length+1, 0); group <= current; group++ {
+			var state any
+			if err := store.get_value([]byte(fmt.Sprintf("%s/%s/%d", store.namespace, id, group%length)), &state); err != nil {
+				return nil, fmt.Errorf("%s bucket %d: %w", id, group%length, err)
+			}
+			if state != nil {
+				window.Buckets = append(window.Buckets, store_interface.Bucket_snapshot{Bucket_group: group, State: state})
+			}
+		}
+		windows[id] = window
+	}
+
+	return windows, nil
+}
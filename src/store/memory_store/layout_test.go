@@ -0,0 +1,273 @@
+package memory_store
+
+import (
+	"bytes"
+	"math/big"
+	"reflect"
+	"testing"
+
+	store_interface "example.com/streaming-metrics/src/store"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// store persisted to a pebble db in a temporary directory
+func new_test_store(t *testing.T, granularity int64, cardinality int64, codec_name string) *Memory_store {
+	db, err := pebble.Open(t.TempDir(), &pebble.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return &Memory_store{
+		namespace:     "ns",
+		granularity:   granularity,
+		cardinality:   cardinality,
+		time_unit:     "s",
+		db:            db,
+		write_options: pebble.NoSync,
+		codec_name:    codec_name,
+		codec:         state_codecs[codec_name],
+		windows:       make(map[string]*Window),
+	}
+}
+
+func TestPrefix_end(t *testing.T) {
+	cases := []struct {
+		prefix []byte
+		end    []byte
+	}{
+		{[]byte("ns/"), []byte("ns0")},
+		{[]byte("ns/w/a/"), []byte("ns/w/a0")},
+		{[]byte("a\xff"), []byte("b")},
+		{[]byte("a\xfe\xff"), []byte("a\xff")},
+		{[]byte("\xff\xff"), nil},
+		{[]byte{}, nil},
+	}
+
+	for _, c := range cases {
+		if end := prefix_end(c.prefix); !bytes.Equal(end, c.end) {
+			t.Errorf("prefix_end(%q) = %q, expected %q", c.prefix, end, c.end)
+		}
+	}
+}
+
+func TestKeys(t *testing.T) {
+	cases := []struct {
+		key      []byte
+		expected string
+	}{
+		{windows_prefix("ns", 0), "ns/w/"},
+		{windows_prefix("ns", 1), "ns/w1/"},
+		{window_prefix("ns", 0, "a"), "ns/w/a/"},
+		{window_prefix("ns", 0, "a/b c"), "ns/w/a%2Fb%20c/"},
+		{window_prefix("ns", 1, "a"), "ns/w1/a/"},
+		{current_bucket_group_key("ns", 0, "a/b"), "ns/w/a%2Fb/current"},
+		{bucket_key("ns", 0, "a/b", 12), "ns/w/a%2Fb/12"},
+		{bucket_key("ns", 1, "a/b", 12), "ns/w1/a%2Fb/12"},
+		{new_meta_keys("ns").state_codec, "ns/meta/state_codec"},
+		{new_meta_keys("ns").generation, "ns/meta/generation"},
+		{new_legacy_meta_keys("ns").granularity, "ns/granularity"},
+	}
+
+	for _, c := range cases {
+		if string(c.key) != c.expected {
+			t.Errorf("key %q, expected %q", c.key, c.expected)
+		}
+	}
+
+	in_range := func(key []byte, prefix []byte) bool {
+		return bytes.Compare(key, prefix) >= 0 && bytes.Compare(key, prefix_end(prefix)) < 0
+	}
+	// a window is one prefix: the range of a does not contain the keys of the windows starting with a
+	prefix := window_prefix("ns", 0, "a")
+	for _, key := range [][]byte{bucket_key("ns", 0, "ab", 0), bucket_key("ns", 0, "a/b", 0), current_bucket_group_key("ns", 0, "a0")} {
+		if in_range(key, prefix) {
+			t.Errorf("key %q in the range of window a", key)
+		}
+	}
+	// nor a generation the keys of the other one
+	if in_range(bucket_key("ns", 1, "a", 0), windows_prefix("ns", 0)) || in_range(bucket_key("ns", 0, "a", 0), windows_prefix("ns", 1)) {
+		t.Errorf("the generations overlap")
+	}
+}
+
+func TestRead_windows(t *testing.T) {
+	for _, codec_name := range []string{"json", "cbor"} {
+		store := new_test_store(t, 5, 2, codec_name)
+
+		windows := map[string]resampled_window{
+			// bucket groups 5 6 7 at the indexes 2 0 1, 6 without a state
+			"a/b": {current: 7, buckets: []any{nil, "g7", "g5"}},
+			"c":   {current: 1, buckets: []any{"g0", "g1", nil}},
+			"d":   {current: 4, buckets: []any{nil, nil, nil}},
+		}
+		if err := store.write_windows(windows, 39); err != nil {
+			t.Fatal(err)
+		}
+
+		read, err := store.read_windows(store.generation, store.cardinality, store.codec)
+		if err != nil {
+			t.Fatalf("%s read_windows: %v", codec_name, err)
+		}
+		expected := map[string]*store_interface.Window_snapshot{
+			"a/b": {Current_bucket_group: 7, Buckets: []store_interface.Bucket_snapshot{{Bucket_group: 5, State: "g5"}, {Bucket_group: 7, State: "g7"}}},
+			"c":   {Current_bucket_group: 1, Buckets: []store_interface.Bucket_snapshot{{Bucket_group: 0, State: "g0"}, {Bucket_group: 1, State: "g1"}}},
+			"d":   {Current_bucket_group: 4},
+		}
+		if !reflect.DeepEqual(read, expected) {
+			t.Errorf("%s read_windows = %+v, expected %+v", codec_name, read, expected)
+		}
+
+		meta, found, err := store.read_metadata()
+		if err != nil || !found {
+			t.Fatalf("%s read_metadata: found %t %v", codec_name, found, err)
+		}
+		expected_meta := persisted_metadata{granularity: 5, cardinality: 2, time_unit: "s", current_time: 39, codec_name: codec_name, generation: 1}
+		if meta != expected_meta {
+			t.Errorf("%s read_metadata = %+v, expected %+v", codec_name, meta, expected_meta)
+		}
+	}
+}
+
+func TestRead_windows_corrupt(t *testing.T) {
+	store := new_test_store(t, 5, 2, "json")
+	if err := store.write_windows(map[string]resampled_window{"a": {current: 1, buckets: []any{"g0", nil, nil}}}, 5); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.db.Set(bucket_key("ns", store.generation, "a", 1), []byte("{"), pebble.Sync); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.read_windows(store.generation, store.cardinality, store.codec); err == nil {
+		t.Errorf("read_windows of a corrupt value: expected an error")
+	}
+}
+
+func TestWrite_windows_legacy(t *testing.T) {
+	store := new_test_store(t, 5, 2, "json")
+	legacy := map[string]string{
+		"ns/granularity":            "5",
+		"ns/cardinality":            "2",
+		"ns/current_time":           "12",
+		"ns/len_windows":            "1",
+		"ns/window/0":               `"a"`,
+		"ns/a/current_bucket_group": "2",
+		"ns/a/0":                    `"g0"`,
+		"ns/a/1":                    "null",
+		"ns/a/2":                    `"g2"`,
+		"other/granularity":         "10",
+	}
+	for key, value := range legacy {
+		if err := store.db.Set([]byte(key), []byte(value), pebble.Sync); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	meta, found, err := store.read_metadata()
+	if err != nil || !found || !meta.legacy || meta.current_time != 12 || meta.codec_name != "json" {
+		t.Fatalf("legacy read_metadata = %+v found %t %v", meta, found, err)
+	}
+	windows, err := store.read_persisted_windows(meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.write_windows(store.resample_windows(windows, meta.granularity, meta.time_unit), meta.current_time); err != nil {
+		t.Fatal(err)
+	}
+
+	meta, found, err = store.read_metadata()
+	if err != nil || !found || meta.legacy || meta.current_time != 12 {
+		t.Fatalf("read_metadata after the rewrite = %+v found %t %v", meta, found, err)
+	}
+	rewritten, err := store.read_persisted_windows(meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(rewritten, windows) {
+		t.Errorf("rewritten windows %+v, expected %+v", rewritten, windows)
+	}
+
+	// only the keys of the layout are left, the other namespaces are untouched
+	iter, err := store.db.NewIter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer iter.Close()
+	for iter.First(); iter.Valid(); iter.Next() {
+		key := iter.Key()
+		if !bytes.HasPrefix(key, []byte("ns/meta/")) && !bytes.HasPrefix(key, windows_prefix("ns", store.generation)) && string(key) != "other/granularity" {
+			t.Errorf("key %q left after the rewrite", key)
+		}
+	}
+}
+
+func TestWrite_windows_interrupted(t *testing.T) {
+	store := new_test_store(t, 5, 2, "json")
+	previous := map[string]resampled_window{
+		"a": {current: 1, buckets: []any{"a0", "a1", nil}},
+		"b": {current: 2, buckets: []any{nil, nil, "b2"}},
+	}
+	if err := store.write_windows(previous, 10); err != nil {
+		t.Fatal(err)
+	}
+	expected, err := store.read_windows(store.generation, store.cardinality, store.codec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the rewrite stops (crash) after its first chunk is committed
+	defer func(size int) { rewrite_batch_size, rewrite_chunk_committed = size, nil }(rewrite_batch_size)
+	rewrite_batch_size = 1
+	rewrite_chunk_committed = func() { panic("crash") }
+	func() {
+		defer func() { recover() }()
+		store.write_windows(map[string]resampled_window{
+			"a": {current: 5, buckets: []any{"x", nil, nil}},
+			"c": {current: 5, buckets: []any{"y", nil, nil}},
+		}, 25)
+		t.Fatalf("write_windows was not interrupted")
+	}()
+	rewrite_chunk_committed = nil
+
+	// restart: the previous metadata and windows are loaded
+	restarted := new_test_store(t, 5, 2, "json")
+	restarted.db = store.db
+	loaded, err := restarted.try_load_from_db()
+	if err != nil || !loaded {
+		t.Fatalf("try_load_from_db after the interrupted rewrite: loaded %t %v", loaded, err)
+	}
+	if restarted.current_time != 10 || restarted.generation != 1 {
+		t.Errorf("current_time %d generation %d, expected 10 1", restarted.current_time, restarted.generation)
+	}
+	read, err := restarted.read_windows(restarted.generation, restarted.cardinality, restarted.codec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(read, expected) {
+		t.Errorf("windows after the interrupted rewrite %+v, expected %+v", read, expected)
+	}
+
+	// the staged windows are deleted
+	staging := windows_prefix("ns", 1-restarted.generation)
+	iter, err := store.db.NewIter(&pebble.IterOptions{LowerBound: staging, UpperBound: prefix_end(staging)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer iter.Close()
+	if iter.First() {
+		t.Errorf("staged key %q left", iter.Key())
+	}
+}
+
+func TestJson_codec_integers(t *testing.T) {
+	var state any
+	if err := state_codecs["json"].unmarshal([]byte(`{"a":[9007199254740993,123456789012345678901234567890,1.5]}`), &state); err != nil {
+		t.Fatal(err)
+	}
+	big_int, _ := new(big.Int).SetString("123456789012345678901234567890", 10)
+	expected := map[string]any{"a": []any{int64(9007199254740993), big_int, 1.5}}
+	if !reflect.DeepEqual(state, expected) {
+		t.Errorf("json unmarshal = %#v, expected %#v", state, expected)
+	}
+}
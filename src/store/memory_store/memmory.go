@@ -1,9 +1,11 @@
 package memory_store
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"sync"
+	"sync/atomic"
 
 	store_interface "example.com/streaming-metrics/src/store"
 
@@ -17,25 +19,90 @@ var (
 	global_db       *pebble.DB = nil
 )
 
+/*
+ * Makes every write done so far to the persistent stores durable (a synced write of the pebble WAL)
+ */
+func Checkpoint() error {
+	global_db_mutex.Lock()
+	db := global_db
+	global_db_mutex.Unlock()
+
+	if db == nil {
+		return nil
+	}
+
+	if err := sync_db(db); err != nil {
+		return fmt.Errorf("memory_store Checkpoint: %w", err)
+	}
+	return nil
+}
+
+/*
+ * Syncs and closes the pebble db shared by the persistent stores (no store can be used afterwards)
+ */
+func Close_persistence() error {
+	stop_sync_loop()
+
+	global_db_mutex.Lock()
+	defer global_db_mutex.Unlock()
+
+	if global_db == nil {
+		return nil
+	}
+
+	if !persistence_options.Read_only {
+		if err := sync_db(global_db); err != nil {
+			return fmt.Errorf("memory_store Close_persistence sync: %w", err)
+		}
+		if err := global_db.Flush(); err != nil {
+			logrus.Errorf("memory_store Close_persistence flush: %+v", err)
+		}
+	}
+	if err := global_db.Close(); err != nil {
+		return fmt.Errorf("memory_store Close_persistence close: %w", err)
+	}
+	global_db = nil
+
+	return nil
+}
+
 type Memory_store struct {
-	namespace      string
-	granularity    int64
-	cardinality    int64
-	snapshot       int64
-	current        bool
-	current_time   int64
-	windows        map[string]*Window
-	windows_idx_db map[string]int
-	idx_windows_db map[int]string
-
-	db *pebble.DB
+	namespace    string
+	granularity  int64
+	cardinality  int64
+	snapshot     int64
+	current      bool
+	time_unit    string
+	current_time int64
+	windows      map[string]*Window
+
+	db            *pebble.DB
+	write_options *pebble.WriteOptions
+	migration     *Migration
+	codec_name    string
+	codec         state_codec
+	// of the persisted windows, see layout.go
+	generation int64
 
 	current_time_key []byte
 
+	// set by Hand_over, every call is forwarded to it (with the rwmutex)
+	successor store_interface.Store
+
+	track_closed_buckets atomic.Bool
+	closed_buckets       []store_interface.Closed_bucket
+	closed_mutex         sync.Mutex
+	// a bucket is closed once the store time passes its end plus closed_lateness (set by Set_track_closed_buckets)
+	closed_lateness   int64
+	closed_configured bool
+
 	rwmutex sync.RWMutex
 }
 
-func New_memory_store(namespace string, granularity int64, cardinality int64, snapshot int64, current bool) store_interface.Store {
+/*
+ * time_unit - unit of granularity and of the times pushed (s - ms - us), only checked against the persisted data
+ */
+func New_memory_store(namespace string, granularity int64, cardinality int64, snapshot int64, current bool, time_unit string) store_interface.Store {
 	if !valid_memory_inputs(namespace, granularity, cardinality, snapshot, current) {
 		return nil
 	}
@@ -46,44 +113,69 @@ func New_memory_store(namespace string, granularity int64, cardinality int64, sn
 		cardinality: cardinality,
 		snapshot:    snapshot,
 		current:     current,
+		time_unit:   time_unit,
 		db:          nil,
 		windows:     make(map[string]*Window),
 	}
 }
 
-func New_cached_persistent_store(namespace string, granularity int64, cardinality int64, snapshot int64, current bool) store_interface.Store {
+/*
+ * synced - every write is synced to the WAL before returning (see Persistence_options)
+ * migration - of the persisted windows if granularity or cardinality changed (nil keeps the most recent states)
+ * codec_name - encoding of the persisted states (cbor - json), the windows are rewritten on a change;
+ *	empty keeps the codec of the persisted data (Default_state_codec for a new namespace)
+ */
+func New_cached_persistent_store(namespace string, granularity int64, cardinality int64, snapshot int64, current bool, time_unit string, synced bool, migration *Migration, codec_name string) store_interface.Store {
 	if !valid_memory_inputs(namespace, granularity, cardinality, snapshot, current) {
 		return nil
 	}
 
-	global_db_mutex.Lock()
-	if global_db == nil {
-		t_db, err := pebble.Open("persistent_data", &pebble.Options{})
-		if err != nil {
-			logrus.Errorf("memory new_cached_persistent_store open pebble db %s: %+v", namespace, err)
-			global_db_mutex.Unlock()
+	var codec state_codec
+	if codec_name != "" {
+		var err error
+		if codec, err = get_state_codec(codec_name); err != nil {
+			logrus.Errorf("memory new_cached_persistent_store %s: %+v", namespace, err)
 			return nil
 		}
-		global_db = t_db
 	}
-	db := global_db
-	global_db_mutex.Unlock()
+
+	if persistence_options.Read_only {
+		logrus.Errorf("memory new_cached_persistent_store %s: pebble db opened read-only", namespace)
+		return nil
+	}
+	db, err := shared_db()
+	if err != nil {
+		logrus.Errorf("memory new_cached_persistent_store open pebble db %s: %+v", namespace, err)
+		return nil
+	}
 
 	memory := &Memory_store{
-		namespace:      namespace,
-		granularity:    granularity,
-		cardinality:    cardinality,
-		snapshot:       snapshot,
-		current:        current,
-		db:             db,
-		windows:        make(map[string]*Window),
-		windows_idx_db: make(map[string]int),
-		idx_windows_db: make(map[int]string),
+		namespace:     namespace,
+		granularity:   granularity,
+		cardinality:   cardinality,
+		snapshot:      snapshot,
+		current:       current,
+		time_unit:     time_unit,
+		db:            db,
+		write_options: write_options(synced),
+		migration:     migration,
+		codec_name:    codec_name,
+		codec:         codec,
+		windows:       make(map[string]*Window),
 	}
 
 	memory.generate_constants()
 
-	if !memory.try_load_from_db() {
+	loaded, err := memory.try_load_from_db()
+	if err != nil {
+		// the persisted data is kept (a transient error must not reset it)
+		logrus.Errorf("memory new_cached_persistent_store %s: unable to load the persisted windows: %+v", namespace, err)
+		return nil
+	}
+	if !loaded {
+		if memory.codec == nil {
+			memory.codec_name, memory.codec = Default_state_codec, state_codecs[Default_state_codec]
+		}
 		memory.activate_cached_persistence()
 	}
 
@@ -92,14 +184,20 @@ func New_cached_persistent_store(namespace string, granularity int64, cardinalit
 
 func (store *Memory_store) Tick(t int64) {
 	store.rwmutex.RLock()
+	if successor := store.successor; successor != nil {
+		store.rwmutex.RUnlock()
+		successor.Tick(t)
+		return
+	}
 	if store.current_time < t {
 		//TODO mutex arround this update (is iteven necessary? - unlikely to be concurrency and temporary incorrect value is good enough)
+		closed := store.closed_bucket_group(t)
 		for _, window := range store.windows {
-			window.update_time(t)
+			window.update_time(t, closed)
 		}
 		store.current_time = t
 		if store.db != nil {
-			store.db.Set(store.current_time_key, store.safe_marshal(store.current_time), pebble.NoSync)
+			store.db.Set(store.current_time_key, store.safe_marshal(store.current_time), store.write_options)
 		}
 	}
 	store.rwmutex.RUnlock()
@@ -108,36 +206,142 @@ func (store *Memory_store) Tick(t int64) {
 	store.check_and_remove_unused_windows()
 }
 
-func (store *Memory_store) Push(id string, t int64, metric any, lambda *gojq.Code) {
+func (store *Memory_store) Current_time() int64 {
+	store.rwmutex.RLock()
+	defer store.rwmutex.RUnlock()
+
+	if store.successor != nil {
+		return store.successor.Current_time()
+	}
+	return store.current_time
+}
+
+func (store *Memory_store) Set_track_closed_buckets(track bool, allowed_lateness *int64) {
+	if successor := store.get_successor(); successor != nil {
+		successor.Set_track_closed_buckets(track, allowed_lateness)
+		return
+	}
+
+	store.rwmutex.Lock()
+	// without allowed lateness a bucket can be pushed to until it leaves the window
+	store.closed_lateness = (store.cardinality + 1) * store.granularity
+	if allowed_lateness != nil {
+		store.closed_lateness = *allowed_lateness
+	}
+	store.closed_configured = true
+	store.init_closed()
+	store.rwmutex.Unlock()
+
+	store.track_closed_buckets.Store(track)
+	if !track {
+		store.Closed_buckets()
+	}
+}
+
+// bucket groups before it are closed at t
+func (store *Memory_store) closed_bucket_group(t int64) int64 {
+	if t < store.closed_lateness {
+		return 0
+	}
+	return (t - store.closed_lateness) / store.granularity
+}
+
+// restored windows: the buckets closed at the current time were closed before the restart/reload, requires the lock
+func (store *Memory_store) init_closed() {
+	if !store.closed_configured {
+		return
+	}
+	closed := store.closed_bucket_group(store.current_time)
+	for _, window := range store.windows {
+		window.init_closed(closed)
+	}
+}
+
+// with the ones of the successor after Hand_over (closed before it)
+func (store *Memory_store) Closed_buckets() []store_interface.Closed_bucket {
+	store.closed_mutex.Lock()
+	closed := store.closed_buckets
+	store.closed_buckets = nil
+	store.closed_mutex.Unlock()
+
+	if successor := store.get_successor(); successor != nil {
+		closed = append(closed, successor.Closed_buckets()...)
+	}
+	return closed
+}
+
+func (store *Memory_store) Hand_over(next func(snapshot *store_interface.Snapshot) store_interface.Store) store_interface.Store {
+	store.rwmutex.Lock()
+	defer store.rwmutex.Unlock()
+
+	if store.successor != nil {
+		return store.successor.Hand_over(next)
+	}
+	if successor := next(store.export()); successor != nil {
+		store.successor = successor
+		logrus.Infof("memory_store %s: handed over to a new store", store.namespace)
+		return successor
+	}
+	return nil
+}
+
+// codec of the persisted states (empty without persistence)
+func (store *Memory_store) State_codec() string {
+	return store.codec_name
+}
+
+func (store *Memory_store) get_successor() store_interface.Store {
+	store.rwmutex.RLock()
+	defer store.rwmutex.RUnlock()
+
+	return store.successor
+}
+
+func (store *Memory_store) bucket_closed(id string, bucket_group int64, state any) {
+	if !store.track_closed_buckets.Load() {
+		return
+	}
+
+	store.closed_mutex.Lock()
+	store.closed_buckets = append(store.closed_buckets, store_interface.Closed_bucket{
+		Id:           id,
+		Bucket_start: bucket_group * store.granularity,
+		State:        state,
+	})
+	store.closed_mutex.Unlock()
+}
+
+func (store *Memory_store) Push(ctx context.Context, id string, t int64, metric any, lambda *gojq.Code) bool {
 	store.rwmutex.RLock()
+	if successor := store.successor; successor != nil {
+		store.rwmutex.RUnlock()
+		return successor.Push(ctx, id, t, metric, lambda)
+	}
+	defer store.rwmutex.RUnlock()
 
 	window, ok := store.windows[id]
 	if ok {
-		window.push(t, metric, lambda)
+		return window.push(ctx, t, metric, lambda)
 	} else {
 		store.rwmutex.RUnlock()
 		store.rwmutex.Lock()
+		if successor := store.successor; successor != nil {
+			store.rwmutex.Unlock()
+			store.rwmutex.RLock()
+			return successor.Push(ctx, id, t, metric, lambda)
+		}
 		if _, ok := store.windows[id]; !ok {
+			window := new_window(store.namespace, store.generation, id, store.cardinality, store.granularity, store.current, store.db, store.write_options, store.codec, store.bucket_closed)
 			if store.db != nil {
-				batch := store.db.NewBatch()
-				batch.Set(store.len_windows_key(), store.safe_marshal(len(store.windows)+1), nil)
-				batch.Set(store.window_idx_key(len(store.windows)), store.safe_marshal(id), nil)
-
-				if err := batch.Commit(pebble.NoSync); err != nil {
-					logrus.Errorf("store Push commit failed %s: %+v", store.namespace, err)
-				}
-
-				store.windows_idx_db[id] = len(store.windows)
-				store.idx_windows_db[len(store.windows)] = id
+				window.activate_cached_persistence()
 			}
-			store.windows[id] = new_window(store.namespace, id, store.cardinality, store.granularity, store.current, store.db)
+			store.windows[id] = window
 		}
 		store.rwmutex.Unlock()
 		store.rwmutex.RLock()
 		window := store.windows[id]
-		window.push(t, metric, lambda)
+		return window.push(ctx, t, metric, lambda)
 	}
-	store.rwmutex.RUnlock()
 }
 
 func (store *Memory_store) check_and_remove_unused_windows() {
@@ -152,33 +356,24 @@ func (store *Memory_store) check_and_remove_unused_windows() {
 	store.rwmutex.Lock()
 	defer store.rwmutex.Unlock()
 
-	batch := store.db.NewBatch()
+	if store.successor != nil {
+		return
+	}
+	var batch *pebble.Batch
+	if store.db != nil {
+		batch = store.db.NewBatch()
+	}
 	for _, id := range unused_windows {
 		if window := store.windows[id]; window != nil {
 			if window.check_unused() {
-				if store.db != nil {
-					last_id := store.idx_windows_db[len(store.windows)-1]
-					del_idx := store.windows_idx_db[id]
-
-					batch.Set(store.len_windows_key(), store.safe_marshal(len(store.windows)-1), nil)
-					batch.Set(store.window_idx_key(del_idx), store.safe_marshal(last_id), nil)
-					batch.Delete(store.window_idx_key(len(store.windows)-1), nil)
-
-					store.idx_windows_db[del_idx] = last_id
-					store.windows_idx_db[last_id] = del_idx
-
-					delete(store.idx_windows_db, len(store.windows)-1)
-					delete(store.windows_idx_db, id)
-
-					window.delete_window(batch)
-				}
+				window.delete_window(batch)
 				delete(store.windows, id)
 			}
 		}
 	}
 
 	if store.db != nil {
-		if err := batch.Commit(pebble.NoSync); err != nil {
+		if err := batch.Commit(store.write_options); err != nil {
 			logrus.Errorf("memory check_and_remove_unused_windows commit %s: %+v", store.namespace, err)
 		}
 	}
@@ -199,6 +394,10 @@ func (store *Memory_store) _check_unused_windows() []string {
 func (store *Memory_store) Get_representation() (map[string]any, int64) {
 	store_rep := make(map[string]any)
 	store.rwmutex.RLock()
+	if successor := store.successor; successor != nil {
+		store.rwmutex.RUnlock()
+		return successor.Get_representation()
+	}
 
 	logrus.Tracef("memory store %+v", store)
 
@@ -213,143 +412,108 @@ func valid_memory_inputs(namespace string, granularity int64, cardinality int64,
 	return len(namespace) > 0 && granularity > 0 && cardinality > 0 && snapshot > 0
 }
 
-/*
- *	BD Keys
- */
-
-func (store *Memory_store) len_windows_key() []byte {
-	return []byte(fmt.Sprintf("%s/len_windows", store.namespace))
-}
-
-func (store *Memory_store) granularity_key() []byte {
-	return []byte(fmt.Sprintf("%s/granularity", store.namespace))
-}
-
-func (store *Memory_store) cardinality_key() []byte {
-	return []byte(fmt.Sprintf("%s/cardinality", store.namespace))
-}
-
-func (store *Memory_store) window_idx_key(index int) []byte {
-	return []byte(fmt.Sprintf("%s/window/%d", store.namespace, index))
-}
-
 func (store *Memory_store) generate_constants() {
-	store.current_time_key = []byte(fmt.Sprintf("%s/current_time", store.namespace))
+	store.current_time_key = new_meta_keys(store.namespace).current_time
 }
 
 /*
- *	Loads/Persistence
+ *	Loads/Persistence (see layout.go)
  */
 
 func (store *Memory_store) activate_cached_persistence() {
 	logrus.Infof("memmory try_load_from_db %s: Persiste namespace", store.namespace)
 	batch := store.db.NewBatch()
-	batch.Set(store.granularity_key(), store.safe_marshal(store.granularity), nil)
-	batch.Set(store.cardinality_key(), store.safe_marshal(store.cardinality), nil)
-	batch.Set(store.len_windows_key(), store.safe_marshal(0), nil)
-	batch.Set(store.current_time_key, store.safe_marshal(0), nil)
+	store.delete_namespace_keys(batch)
+	store.set_metadata(batch, 0)
 
-	if err := batch.Commit(pebble.NoSync); err != nil {
+	if err := batch.Commit(store.write_options); err != nil {
 		store.db = nil
 		logrus.Errorf("memory activate_cached_persistence commit failed (using only memmory) %s: %v", store.namespace, err)
 	}
 }
 
-func (store *Memory_store) try_load_from_db() (ok bool) {
-
-	bd_granularity, closer_gran, err_gran := store.db.Get(store.granularity_key())
-	bd_cardinality, closer_card, err_card := store.db.Get(store.cardinality_key())
-	defer func() {
-		if closer_gran != nil {
-			if err := closer_gran.Close(); err != nil {
-				logrus.Errorf("memory try_load_from_db close granularity %s: %+v", store.namespace, err)
-			}
-		}
-		if closer_card != nil {
-			if err := closer_card.Close(); err != nil {
-				logrus.Errorf("memory try_load_from_db close cardinality %s: %+v", store.namespace, err)
-			}
-		}
-	}()
-
-	if err_gran == pebble.ErrNotFound || err_card == pebble.ErrNotFound {
+/*
+ * Loads the persisted windows, rewritten first if they are in the legacy layout,
+ * if granularity/cardinality/time_unit changed (migration) or if the state codec changed
+ *
+ * not loaded (reset by activate_cached_persistence) only if nothing is persisted or on migration.Reset,
+ * any other failure is an error (the persisted data is kept)
+ */
+func (store *Memory_store) try_load_from_db() (bool, error) {
+	meta, found, err := store.read_metadata()
+	if err != nil {
+		return false, err
+	}
+	if !found {
 		logrus.Debugf("memmory try_load_from_db %s: Namespace not persisted to pebble DB yet.", store.namespace)
-		return false
-	} else if err_gran != nil || err_card != nil {
-		logrus.Errorf("memmory try_load_from_db %s: err_gran %+v err_card %+v", store.namespace, err_gran, err_card)
-		return false
+		return false, nil
 	}
 
-	var my_gran, my_card int64
-	store.safe_unmarshal(bd_granularity, &my_gran)
-	store.safe_unmarshal(bd_cardinality, &my_card)
-
-	if my_gran != store.granularity || my_card != store.cardinality {
-		logrus.Errorf("memmory try_load_from_db %s: Config: {granularity:%d, cardinality:%d} BD: {granularity:%d, cardinality:%d}", store.namespace, store.granularity, store.cardinality, my_gran, my_card)
-		return false
+	if _, ok := time_unit_nanoseconds[meta.time_unit]; !ok {
+		return false, fmt.Errorf("%s is not a valid time_unit", meta.time_unit)
 	}
 
-	return store.try_load_windows_from_db()
-}
-
-func (store *Memory_store) try_load_windows_from_db() (ok bool) {
+	migrate := meta.granularity != store.granularity || meta.cardinality != store.cardinality || meta.time_unit != store.time_unit
+	if migrate {
+		logrus.Errorf("memmory try_load_from_db %s: Config: {granularity:%d, cardinality:%d, time_unit:%s} BD: {granularity:%d, cardinality:%d, time_unit:%s}", store.namespace, store.granularity, store.cardinality, store.time_unit, meta.granularity, meta.cardinality, meta.time_unit)
+		if store.migration != nil && store.migration.Reset {
+			return false, nil
+		}
+	}
 
-	bd_current_time, closer, err := store.db.Get(store.current_time_key)
+	windows, err := store.read_persisted_windows(meta)
 	if err != nil {
-		logrus.Errorf("memory try_load_windows_from_db %s - Unable to get store current time: %+v", store.namespace, err)
-		return false
+		return false, err
 	}
-	var current_time int64
-	store.safe_unmarshal(bd_current_time, &current_time)
-
-	if err := closer.Close(); err != nil {
-		logrus.Errorf("memory try_load_windows_from_db close current_time %s: %+v", store.namespace, err)
+	store.generation = meta.generation
+	if store.codec == nil {
+		store.codec_name, store.codec = meta.codec_name, state_codecs[meta.codec_name]
 	}
 
-	bd_number_windows, closer, err := store.db.Get(store.len_windows_key())
-	if err != nil {
-		logrus.Errorf("memory try_load_windows_from_db %s - Unable to get number of windows: %+v", store.namespace, err)
-		return false
+	resampled := store.resample_windows(windows, meta.granularity, meta.time_unit)
+	current_time := store.rescale_time(meta.current_time, meta.time_unit)
+	if meta.legacy || migrate || meta.codec_name != store.codec_name {
+		logrus.Warnf("memory_store %s: rewriting %d windows (legacy layout %t) {granularity:%d, cardinality:%d, time_unit:%s, state_codec:%s} to {granularity:%d, cardinality:%d, time_unit:%s, state_codec:%s}",
+			store.namespace, len(windows), meta.legacy, meta.granularity, meta.cardinality, meta.time_unit, meta.codec_name, store.granularity, store.cardinality, store.time_unit, store.codec_name)
+		if err := store.write_windows(resampled, current_time); err != nil {
+			return false, fmt.Errorf("rewrite: %w", err)
+		}
+	} else {
+		store.delete_staged_windows()
 	}
-	var number_windows int
-	store.safe_unmarshal(bd_number_windows, &number_windows)
 
-	if err := closer.Close(); err != nil {
-		logrus.Errorf("memory try_load_windows_from_db close number_windows_key %s: %+v", store.namespace, err)
-	}
-	for idx := 0; idx < number_windows; idx++ {
-		bd_id, closer, err := store.db.Get(store.window_idx_key(idx))
-		if err != nil {
-			logrus.Errorf("memory try_load_windows_from_db %s - Unable to get windows idx %d: %+v", store.namespace, idx, err)
-			for k := range store.windows {
-				delete(store.windows, k)
-			}
-			for k := range store.windows_idx_db {
-				delete(store.windows_idx_db, k)
-			}
-			for k := range store.idx_windows_db {
-				delete(store.idx_windows_db, k)
-			}
-			return false
-		}
-		var id string
-		store.safe_unmarshal(bd_id, &id)
-		if err := closer.Close(); err != nil {
-			logrus.Errorf("store try_load_windows_from_db close window id %d - %s: %+v", idx, store.namespace, err)
-		}
-		store.windows_idx_db[id] = idx
-		store.idx_windows_db[idx] = id
+	store.restore_windows(resampled, current_time)
 
-		store.windows[id] = new_window(store.namespace, id, store.cardinality, store.granularity, store.current, store.db)
-	}
+	return true, nil
+}
 
-	store.current_time = current_time
+// only persisted for other units than seconds (older data has no time_unit)
+func (store *Memory_store) load_time_unit(key []byte) (string, error) {
+	var time_unit string
+	if err := store.get_value(key, &time_unit); err == pebble.ErrNotFound {
+		return "s", nil
+	} else if err != nil {
+		return "", fmt.Errorf("time_unit: %w", err)
+	}
+	return time_unit, nil
+}
 
-	return true
+// json for data persisted before the state codecs (no state_codec key)
+func (store *Memory_store) load_state_codec(key []byte) (string, error) {
+	if key == nil {
+		return "json", nil
+	}
+	var codec string
+	if err := store.get_value(key, &codec); err == pebble.ErrNotFound {
+		return "json", nil
+	} else if err != nil {
+		return "", fmt.Errorf("state_codec: %w", err)
+	}
+	return codec, nil
 }
 
 /*
- *	Marshal
+ *	Marshal (metadata json, window values with the state codec)
  */
 
 func (store *Memory_store) safe_marshal(v any) []byte {
@@ -369,3 +533,12 @@ func (store *Memory_store) safe_unmarshal(b []byte, v any) any {
 	}
 	return v
 }
+
+func (store *Memory_store) marshal_state(v any) []byte {
+	b, err := store.codec.marshal(v)
+	if err != nil {
+		logrus.Errorf("memory_store marshal state %s: %+v", store.namespace, err)
+		return []byte("")
+	}
+	return b
+}
@@ -0,0 +1,207 @@
+package memory_store
+
+import (
+	"fmt"
+	"time"
+
+	store_interface "example.com/streaming-metrics/src/store"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/sirupsen/logrus"
+)
+
+/*
+ * Migration - what happens to the persisted windows when granularity, cardinality or time_unit changed
+ *
+ *	Reset - the history is dropped
+ *	Merge - new state of the old buckets (chronological) falling in the same new bucket,
+ *		nil keeps the most recent one
+ */
+type Migration struct {
+	Reset bool
+	Merge func(states []any) (any, error)
+}
+
+func (migration *Migration) resample(states []any) any {
+	if migration == nil || migration.Merge == nil || len(states) == 1 {
+		return states[len(states)-1]
+	}
+	state, err := migration.Merge(states)
+	if err != nil {
+		logrus.Errorf("memory_store migration merge: %+v (keeping the most recent state)", err)
+		return states[len(states)-1]
+	}
+	return state
+}
+
+// nanoseconds of the time units (s - ms - us)
+var time_unit_nanoseconds = map[string]int64{
+	"s":  int64(time.Second),
+	"ms": int64(time.Millisecond),
+	"us": int64(time.Microsecond),
+}
+
+// times in time_unit to the store time unit
+func (store *Memory_store) rescale_time(t int64, time_unit string) int64 {
+	return t * time_unit_nanoseconds[time_unit] / time_unit_nanoseconds[store.time_unit]
+}
+
+// a bucket group at granularity (in time_unit) to the bucket group of the store containing its start
+func (store *Memory_store) rescale_bucket_group(bucket_group int64, granularity int64, time_unit string) int64 {
+	return store.rescale_time(bucket_group*granularity, time_unit) / store.granularity
+}
+
+/*
+ * Resamples the buckets of window (at granularity in time_unit) to the store layout:
+ * returns its current bucket group and its buckets (indexed by bucket group)
+ */
+func (store *Memory_store) resample(granularity int64, time_unit string, window *store_interface.Window_snapshot) (int64, []any) {
+	new_len := store.cardinality + 1
+	new_current := store.rescale_bucket_group(window.Current_bucket_group, granularity, time_unit)
+
+	resampled := make(map[int64][]any)
+	for _, bucket := range window.Buckets {
+		new_group := store.rescale_bucket_group(bucket.Bucket_group, granularity, time_unit)
+		if bucket.State == nil || new_group <= new_current-new_len || new_group > new_current {
+			continue
+		}
+		resampled[new_group] = append(resampled[new_group], bucket.State)
+	}
+
+	buckets := make([]any, new_len)
+	for group, states := range resampled {
+		buckets[group%new_len] = store.migration.resample(states)
+	}
+	return new_current, buckets
+}
+
+// window in the store layout: current bucket group and buckets (indexed by bucket group)
+type resampled_window struct {
+	current int64
+	buckets []any
+}
+
+/*
+ * Resamples windows (at granularity in time_unit) once, the result is both persisted and restored
+ * (migration.Merge runs once per bucket)
+ */
+func (store *Memory_store) resample_windows(windows map[string]*store_interface.Window_snapshot, granularity int64, time_unit string) map[string]resampled_window {
+	resampled := make(map[string]resampled_window, len(windows))
+	for id, window := range windows {
+		if window == nil {
+			continue
+		}
+		current, buckets := store.resample(granularity, time_unit, window)
+		resampled[id] = resampled_window{current: current, buckets: buckets}
+	}
+	return resampled
+}
+
+// persists window in the layout of the store, under generation
+func (store *Memory_store) set_window(batch *pebble.Batch, generation int64, id string, window resampled_window) {
+	batch.Set(current_bucket_group_key(store.namespace, generation, id), store.marshal_state(window.current), nil)
+	for index, state := range window.buckets {
+		if state != nil {
+			batch.Set(bucket_key(store.namespace, generation, id, index), store.marshal_state(state), nil)
+		}
+	}
+}
+
+func (store *Memory_store) set_metadata(batch *pebble.Batch, current_time int64) {
+	keys := new_meta_keys(store.namespace)
+	batch.Set(keys.granularity, store.safe_marshal(store.granularity), nil)
+	batch.Set(keys.cardinality, store.safe_marshal(store.cardinality), nil)
+	if store.time_unit != "s" {
+		batch.Set(keys.time_unit, store.safe_marshal(store.time_unit), nil)
+	}
+	batch.Set(keys.current_time, store.safe_marshal(current_time), nil)
+	batch.Set(keys.state_codec, store.safe_marshal(store.codec_name), nil)
+	batch.Set(keys.generation, store.safe_marshal(store.generation), nil)
+}
+
+// size of a batch of write_windows before it is committed (a namespace can have millions of windows)
+var rewrite_batch_size = 4 << 20
+
+// tests: called after each chunk of write_windows is committed
+var rewrite_chunk_committed func()
+
+/*
+ * Replaces every key of the namespace with windows (see resample_windows)
+ *
+ * The windows are staged in chunks in the other generation, the last commit writes the metadata
+ * of that generation and deletes every other key of the namespace: until then the previous
+ * metadata and windows (or legacy keys) are untouched, so a crash in between restarts from them
+ */
+func (store *Memory_store) write_windows(windows map[string]resampled_window, current_time int64) error {
+	namespace_prefix := []byte(store.namespace + "/")
+	generation := 1 - store.generation
+	staging := windows_prefix(store.namespace, generation)
+
+	batch := store.db.NewBatch()
+	// left by an interrupted rewrite
+	batch.DeleteRange(staging, prefix_end(staging), nil)
+	for id, window := range windows {
+		store.set_window(batch, generation, id, window)
+		if batch.Len() >= rewrite_batch_size {
+			if err := batch.Commit(pebble.NoSync); err != nil {
+				return err
+			}
+			if rewrite_chunk_committed != nil {
+				rewrite_chunk_committed()
+			}
+			batch = store.db.NewBatch()
+		}
+	}
+
+	// every other key of the namespace (previous generation, legacy layout, metadata), then the metadata
+	batch.DeleteRange(namespace_prefix, staging, nil)
+	batch.DeleteRange(prefix_end(staging), prefix_end(namespace_prefix), nil)
+	previous := store.generation
+	store.generation = generation
+	store.set_metadata(batch, current_time)
+
+	if err := batch.Commit(pebble.Sync); err != nil {
+		store.generation = previous
+		return err
+	}
+	return nil
+}
+
+// deletes the windows staged by an interrupted rewrite (the other generation)
+func (store *Memory_store) delete_staged_windows() {
+	staging := windows_prefix(store.namespace, 1-store.generation)
+	if err := store.db.DeleteRange(staging, prefix_end(staging), pebble.NoSync); err != nil {
+		logrus.Warnf("memory_store %s: unable to delete the staged windows: %+v", store.namespace, err)
+	}
+}
+
+// replaces the windows in memory with windows (see resample_windows) at current_time, requires the Lock
+func (store *Memory_store) restore_windows(windows map[string]resampled_window, current_time int64) {
+	store.current_time = current_time
+	store.windows = make(map[string]*Window, len(windows))
+	for id, resampled := range windows {
+		window := new_window(store.namespace, store.generation, id, store.cardinality, store.granularity, store.current, store.db, store.write_options, store.codec, store.bucket_closed)
+		window.restore(resampled.current, resampled.buckets)
+		store.windows[id] = window
+	}
+	store.init_closed()
+}
+
+// every key of the namespace, including the ones no longer used by the layout
+func (store *Memory_store) delete_namespace_keys(batch *pebble.Batch) {
+	prefix := []byte(store.namespace + "/")
+	batch.DeleteRange(prefix, prefix_end(prefix), nil)
+}
+
+func (store *Memory_store) get_value(key []byte, v any) error {
+	b, closer, err := store.db.Get(key)
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+
+	if store.safe_unmarshal(b, v) == nil {
+		return fmt.Errorf("unable to unmarshal %s", key)
+	}
+	return nil
+}
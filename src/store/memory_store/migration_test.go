@@ -0,0 +1,164 @@
+package memory_store
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	store_interface "example.com/streaming-metrics/src/store"
+)
+
+func sum_states(states []any) (any, error) {
+	sum := 0
+	for _, state := range states {
+		n, ok := state.(int)
+		if !ok {
+			return nil, fmt.Errorf("%v is not an int", state)
+		}
+		sum += n
+	}
+	return sum, nil
+}
+
+func buckets(groups ...int64) []store_interface.Bucket_snapshot {
+	snapshot := make([]store_interface.Bucket_snapshot, 0, len(groups))
+	for i, group := range groups {
+		snapshot = append(snapshot, store_interface.Bucket_snapshot{Bucket_group: group, State: i + 1})
+	}
+	return snapshot
+}
+
+func TestResample(t *testing.T) {
+	cases := []struct {
+		name                     string
+		granularity, cardinality int64
+		time_unit                string
+		migration                *Migration
+		from_granularity         int64
+		from_time_unit           string
+		window                   *store_interface.Window_snapshot
+		current                  int64
+		buckets                  []any
+	}{
+		{
+			name:        "same granularity",
+			granularity: 5, cardinality: 2, from_granularity: 5,
+			window:  &store_interface.Window_snapshot{Current_bucket_group: 7, Buckets: buckets(5, 6, 7)},
+			current: 7, buckets: []any{2, 3, 1},
+		},
+		{
+			name:        "smaller cardinality drops the oldest",
+			granularity: 5, cardinality: 1, from_granularity: 5,
+			window:  &store_interface.Window_snapshot{Current_bucket_group: 7, Buckets: buckets(5, 6, 7)},
+			current: 7, buckets: []any{2, 3},
+		},
+		{
+			name:        "coarser keeps the most recent",
+			granularity: 10, cardinality: 2, from_granularity: 5,
+			window:  &store_interface.Window_snapshot{Current_bucket_group: 7, Buckets: buckets(4, 5, 6, 7)},
+			current: 3, buckets: []any{4, nil, 2},
+		},
+		{
+			name:        "coarser merged",
+			granularity: 10, cardinality: 2, migration: &Migration{Merge: sum_states}, from_granularity: 5,
+			window:  &store_interface.Window_snapshot{Current_bucket_group: 7, Buckets: buckets(4, 5, 6, 7)},
+			current: 3, buckets: []any{7, nil, 3},
+		},
+		{
+			name:        "merge error keeps the most recent",
+			granularity: 10, cardinality: 2, migration: &Migration{Merge: sum_states}, from_granularity: 5,
+			window: &store_interface.Window_snapshot{Current_bucket_group: 7, Buckets: []store_interface.Bucket_snapshot{
+				{Bucket_group: 6, State: "x"}, {Bucket_group: 7, State: 4},
+			}},
+			current: 3, buckets: []any{4, nil, nil},
+		},
+		{
+			name:        "finer",
+			granularity: 5, cardinality: 4, from_granularity: 10,
+			window:  &store_interface.Window_snapshot{Current_bucket_group: 3, Buckets: buckets(1, 2, 3)},
+			current: 6, buckets: []any{nil, 3, 1, nil, 2},
+		},
+		{
+			name:        "seconds to milliseconds",
+			granularity: 2500, cardinality: 4, time_unit: "ms", from_granularity: 5, from_time_unit: "s",
+			window:  &store_interface.Window_snapshot{Current_bucket_group: 3, Buckets: buckets(1, 2, 3)},
+			current: 6, buckets: []any{nil, 3, 1, nil, 2},
+		},
+		{
+			name:        "microseconds to seconds",
+			granularity: 10, cardinality: 2, time_unit: "s", from_granularity: 5000000, from_time_unit: "us",
+			window:  &store_interface.Window_snapshot{Current_bucket_group: 7, Buckets: buckets(4, 5, 6, 7)},
+			current: 3, buckets: []any{4, nil, 2},
+		},
+		{
+			name:        "nil states skipped",
+			granularity: 10, cardinality: 2, from_granularity: 5,
+			window: &store_interface.Window_snapshot{Current_bucket_group: 7, Buckets: []store_interface.Bucket_snapshot{
+				{Bucket_group: 6, State: 1}, {Bucket_group: 7, State: nil},
+			}},
+			current: 3, buckets: []any{1, nil, nil},
+		},
+	}
+
+	for _, c := range cases {
+		if c.time_unit == "" {
+			c.time_unit, c.from_time_unit = "s", "s"
+		}
+		store := &Memory_store{granularity: c.granularity, cardinality: c.cardinality, time_unit: c.time_unit, migration: c.migration}
+		current, resampled := store.resample(c.from_granularity, c.from_time_unit, c.window)
+		if current != c.current || !reflect.DeepEqual(resampled, c.buckets) {
+			t.Errorf("%s: resample = %d %v, expected %d %v", c.name, current, resampled, c.current, c.buckets)
+		}
+	}
+}
+
+func TestResample_windows(t *testing.T) {
+	store := &Memory_store{granularity: 10, cardinality: 2, time_unit: "s"}
+	windows := map[string]*store_interface.Window_snapshot{
+		"a": {Current_bucket_group: 7, Buckets: buckets(6, 7)},
+		"b": {Current_bucket_group: 2},
+		"c": nil,
+	}
+
+	resampled := store.resample_windows(windows, 5, "s")
+	expected := map[string]resampled_window{
+		"a": {current: 3, buckets: []any{2, nil, nil}},
+		"b": {current: 1, buckets: []any{nil, nil, nil}},
+	}
+	if !reflect.DeepEqual(resampled, expected) {
+		t.Errorf("resample_windows = %+v, expected %+v", resampled, expected)
+	}
+}
+
+func TestTry_load_from_db_time_unit(t *testing.T) {
+	store := new_test_store(t, 5, 4, "json")
+	if err := store.write_windows(map[string]resampled_window{"a": {current: 3, buckets: []any{nil, "g1", "g2", "g3", nil}}}, 17); err != nil {
+		t.Fatal(err)
+	}
+
+	// the same windows in milliseconds
+	ms := new_test_store(t, 2500, 4, "json")
+	ms.db, ms.time_unit = store.db, "ms"
+	loaded, err := ms.try_load_from_db()
+	if err != nil || !loaded {
+		t.Fatalf("try_load_from_db after a time_unit change: loaded %t %v", loaded, err)
+	}
+	if ms.current_time != 17000 {
+		t.Errorf("current_time %d, expected 17000", ms.current_time)
+	}
+
+	meta, _, err := ms.read_metadata()
+	if err != nil || meta.time_unit != "ms" || meta.granularity != 2500 || meta.current_time != 17000 {
+		t.Fatalf("read_metadata after the rewrite = %+v %v", meta, err)
+	}
+	read, err := ms.read_persisted_windows(meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]*store_interface.Window_snapshot{
+		"a": {Current_bucket_group: 6, Buckets: []store_interface.Bucket_snapshot{{Bucket_group: 2, State: "g1"}, {Bucket_group: 4, State: "g2"}, {Bucket_group: 6, State: "g3"}}},
+	}
+	if !reflect.DeepEqual(read, expected) {
+		t.Errorf("windows after a time_unit change %+v, expected %+v", read, expected)
+	}
+}
@@ -0,0 +1,133 @@
+package memory_store
+
+import (
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/sirupsen/logrus"
+)
+
+/*
+ * Persistence_options - the pebble db shared by the persistent stores, set before any is created
+ */
+type Persistence_options struct {
+	// data directory, relative to the working directory if not absolute
+	Dir string
+	// write-ahead log directory (empty is Dir)
+	Wal_dir string
+	// without WAL the writes since the last flush are lost on a crash, checkpoints flush instead (no synced writes)
+	Disable_wal bool
+	// block cache in bytes (0 pebble default)
+	Cache_size int64
+	// period of the background sync of the WAL (flush without WAL), 0 never
+	Sync_interval time.Duration
+	// nothing is written (export), no store can be created
+	Read_only bool
+}
+
+var persistence_options = Persistence_options{Dir: "persistent_data"}
+
+func Set_persistence_options(options Persistence_options) {
+	global_db_mutex.Lock()
+	defer global_db_mutex.Unlock()
+
+	if options.Dir == "" {
+		options.Dir = "persistent_data"
+	}
+	persistence_options = options
+}
+
+// the pebble db shared by the persistent stores, opened by the first one
+func shared_db() (*pebble.DB, error) {
+	global_db_mutex.Lock()
+	defer global_db_mutex.Unlock()
+
+	if global_db == nil {
+		db, err := open_db()
+		if err != nil {
+			return nil, err
+		}
+		global_db = db
+	}
+	return global_db, nil
+}
+
+// with global_db_mutex
+func open_db() (*pebble.DB, error) {
+	options := &pebble.Options{
+		WALDir:     persistence_options.Wal_dir,
+		DisableWAL: persistence_options.Disable_wal,
+		ReadOnly:   persistence_options.Read_only,
+	}
+	if persistence_options.Cache_size > 0 {
+		cache := pebble.NewCache(persistence_options.Cache_size)
+		defer cache.Unref()
+		options.Cache = cache
+	}
+
+	db, err := pebble.Open(persistence_options.Dir, options)
+	if err != nil {
+		return nil, err
+	}
+
+	if persistence_options.Sync_interval > 0 && !persistence_options.Read_only {
+		sync_stop = make(chan struct{})
+		sync_done = make(chan struct{})
+		go sync_loop(persistence_options.Sync_interval, sync_stop, sync_done)
+	}
+
+	logrus.Infof("memory_store: pebble db opened at %s", persistence_options.Dir)
+	return db, nil
+}
+
+var sync_stop, sync_done chan struct{}
+
+func sync_loop(interval time.Duration, stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := Checkpoint(); err != nil {
+				logrus.Errorf("memory_store sync: %+v", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// without global_db_mutex (the sync takes it)
+func stop_sync_loop() {
+	if sync_stop != nil {
+		close(sync_stop)
+		<-sync_done
+		sync_stop, sync_done = nil, nil
+	}
+}
+
+/*
+ * Writes of a store: synced (durable before returning) or not (durable on the next sync/checkpoint)
+ */
+func write_options(synced bool) *pebble.WriteOptions {
+	if synced {
+		return pebble.Sync
+	}
+	return pebble.NoSync
+}
+
+// a write is only synced to the WAL, without it a namespace can not have synced writes
+func Valid_synced_writes(synced bool) bool {
+	return !synced || !persistence_options.Disable_wal
+}
+
+// durable writes: a synced write of the WAL, or a flush of the memtables without it
+func sync_db(db *pebble.DB) error {
+	if persistence_options.Disable_wal {
+		return db.Flush()
+	}
+	return db.LogData(nil, pebble.Sync)
+}
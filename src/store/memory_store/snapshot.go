@@ -0,0 +1,118 @@
+package memory_store
+
+import (
+	"fmt"
+
+	store_interface "example.com/streaming-metrics/src/store"
+)
+
+func (store *Memory_store) Export() *store_interface.Snapshot {
+	store.rwmutex.RLock()
+	defer store.rwmutex.RUnlock()
+
+	if store.successor != nil {
+		return store.successor.Export()
+	}
+	return store.export()
+}
+
+// requires at least a RLock
+func (store *Memory_store) export() *store_interface.Snapshot {
+	snapshot := &store_interface.Snapshot{
+		Namespace:    store.namespace,
+		Granularity:  store.granularity,
+		Cardinality:  store.cardinality,
+		Time_unit:    store.time_unit,
+		Current_time: store.current_time,
+		Windows:      make(map[string]*store_interface.Window_snapshot, len(store.windows)),
+	}
+	for id, window := range store.windows {
+		snapshot.Windows[id] = window.export()
+	}
+
+	return snapshot
+}
+
+/*
+ * Snapshot of namespace as persisted (its layout, granularity, cardinality and codec), without creating
+ * its store: nothing is migrated or rewritten (see Persistence_options.Read_only)
+ */
+func Export_persisted(namespace string) (*store_interface.Snapshot, error) {
+	db, err := shared_db()
+	if err != nil {
+		return nil, fmt.Errorf("memory_store Export_persisted %s: %w", namespace, err)
+	}
+	store := &Memory_store{namespace: namespace, db: db}
+
+	meta, found, err := store.read_metadata()
+	if err != nil {
+		return nil, fmt.Errorf("memory_store Export_persisted %s: %w", namespace, err)
+	}
+	if !found {
+		return nil, fmt.Errorf("memory_store Export_persisted %s: namespace not persisted", namespace)
+	}
+	windows, err := store.read_persisted_windows(meta)
+	if err != nil {
+		return nil, fmt.Errorf("memory_store Export_persisted %s: %w", namespace, err)
+	}
+
+	return &store_interface.Snapshot{
+		Namespace:    namespace,
+		Granularity:  meta.granularity,
+		Cardinality:  meta.cardinality,
+		Time_unit:    meta.time_unit,
+		Current_time: meta.current_time,
+		Windows:      windows,
+	}, nil
+}
+
+/*
+ * Replaces every window of the store (and its persisted keys) with the ones of snapshot (resampled to the store)
+ */
+func (store *Memory_store) Import(snapshot *store_interface.Snapshot) error {
+	time_unit := snapshot.Time_unit
+	if time_unit == "" {
+		time_unit = "s"
+	}
+	if _, ok := time_unit_nanoseconds[time_unit]; !ok {
+		return fmt.Errorf("memory_store Import %s: %s is not a valid time_unit", store.namespace, time_unit)
+	}
+	if err := snapshot.Validate(); err != nil {
+		return fmt.Errorf("memory_store Import %s: %w", store.namespace, err)
+	}
+
+	store.rwmutex.Lock()
+	defer store.rwmutex.Unlock()
+
+	if store.successor != nil {
+		return store.successor.Import(snapshot)
+	}
+	windows := store.resample_windows(snapshot.Windows, snapshot.Granularity, time_unit)
+	current_time := store.rescale_time(snapshot.Current_time, time_unit)
+	if store.db != nil {
+		if err := store.write_windows(windows, current_time); err != nil {
+			return fmt.Errorf("memory_store Import %s commit: %w", store.namespace, err)
+		}
+	}
+	store.restore_windows(windows, current_time)
+
+	return nil
+}
+
+// buckets with a state of the window, oldest first
+func (window *Window) export() *store_interface.Window_snapshot {
+	window.mutex.Lock()
+	defer window.mutex.Unlock()
+
+	snapshot := &store_interface.Window_snapshot{
+		Current_bucket_group: window.current_bucket_group,
+		Buckets:              make([]store_interface.Bucket_snapshot, 0, window.len()),
+	}
+	for group := Max(window.current_bucket_group-window.len()+1, 0); group <= window.current_bucket_group; group++ {
+		if state := window.buckets[window.index(group)].State; state != nil {
+			snapshot.Buckets = append(snapshot.Buckets, store_interface.Bucket_snapshot{Bucket_group: group, State: state})
+		}
+	}
+
+	return snapshot
+}
@@ -1,8 +1,7 @@
 package memory_store
 
 import (
-	"encoding/json"
-	"fmt"
+	"context"
 	"sync"
 
 	"github.com/cockroachdb/pebble"
@@ -12,45 +11,62 @@ import (
 
 type Window struct {
 	namespace            string
+	generation           int64
 	id                   string
 	granularity          int64
 	current_bucket_group int64
 	current              bool
 	buckets              []Bucket
 
-	db *pebble.DB
+	db            *pebble.DB
+	write_options *pebble.WriteOptions
+	codec         state_codec
 
+	prefix                   []byte
 	current_bucket_group_key []byte
 	bucket_keys              [][]byte
 
-	bytes_nil []byte
+	// called (with the lock) once with every bucket with a state when it is closed (see close_buckets)
+	on_close func(id string, bucket_group int64, state any)
+	// bucket groups before it are closed, -1 unknown for a restored window (see init_closed)
+	closed_bucket_group int64
 
 	mutex sync.Mutex
 }
 
-func new_window(namespace string, id string, cardinality int64, granularity int64, current bool, db *pebble.DB) *Window {
+func new_window(namespace string, generation int64, id string, cardinality int64, granularity int64, current bool, db *pebble.DB, write_options *pebble.WriteOptions, codec state_codec, on_close func(id string, bucket_group int64, state any)) *Window {
 
 	window := &Window{
 		namespace:            namespace,
+		generation:           generation,
 		id:                   id,
 		granularity:          granularity,
 		current_bucket_group: 0,
 		current:              current,
 		buckets:              make([]Bucket, cardinality+1),
 
-		db: db,
+		db:            db,
+		write_options: write_options,
+		codec:         codec,
+		on_close:      on_close,
 	}
 
 	if db != nil {
 		window.generate_constants()
-		if !window.try_load_from_db() {
-			window.activate_cached_persistence()
-		}
 	}
 
 	return window
 }
 
+// state loaded from the db or a snapshot (buckets indexed by bucket group)
+func (window *Window) restore(current_bucket_group int64, buckets []any) {
+	window.current_bucket_group = current_bucket_group
+	window.closed_bucket_group = -1
+	for index, state := range buckets {
+		window.buckets[index].State = state
+	}
+}
+
 func (window *Window) len() int64 { return int64(len(window.buckets)) }
 
 func (window *Window) index(bucket_group int64) int64 {
@@ -67,28 +83,63 @@ func (window *Window) first_bucket_group() int64 {
 	}
 }
 
-func (window *Window) push(t int64, metric any, lambda *gojq.Code) {
+// returns false if t is older than the window
+func (window *Window) push(ctx context.Context, t int64, metric any, lambda *gojq.Code) bool {
 	window.mutex.Lock()
 	defer window.mutex.Unlock()
 
-	if window.bucket_group(t) >= window.first_bucket_group() {
-		window._update_time(t)
-		index := window.index(window.bucket_group(t))
-		window.buckets[index].push(metric, lambda)
+	if window.bucket_group(t) < window.first_bucket_group() {
+		return false
+	}
 
-		if window.db != nil {
-			if err := window.db.Set(window.bucket_keys[index], window.safe_marshal(window.buckets[index].State), pebble.NoSync); err != nil {
-				logrus.Errorf("window.push unable to set new state %s %s: %v", window.namespace, window.id, err)
-			}
+	window._update_time(t)
+	index := window.index(window.bucket_group(t))
+	window.buckets[index].push(ctx, metric, lambda)
+
+	if window.db != nil {
+		if err := window.db.Set(window.bucket_keys[index], window.safe_marshal(window.buckets[index].State), window.write_options); err != nil {
+			logrus.Errorf("window.push unable to set new state %s %s: %v", window.namespace, window.id, err)
 		}
 	}
+	return true
 }
 
-func (window *Window) update_time(t int64) {
+// closed - bucket groups before it are closed (the store time passed their end plus the allowed lateness)
+func (window *Window) update_time(t int64, closed int64) {
 	window.mutex.Lock()
 	defer window.mutex.Unlock()
 
 	window._update_time(t)
+	if window.closed_bucket_group < 0 {
+		window.closed_bucket_group = closed
+	}
+	window.close_buckets(closed)
+}
+
+// the buckets of a restored window before closed are considered already closed (before the restart/reload)
+func (window *Window) init_closed(closed int64) {
+	window.mutex.Lock()
+	defer window.mutex.Unlock()
+
+	if window.closed_bucket_group < 0 {
+		window.closed_bucket_group = closed
+	}
+}
+
+/*
+ *	Calls on_close for the buckets before closed not closed yet, only use with the lock
+ */
+func (window *Window) close_buckets(closed int64) {
+	if window.closed_bucket_group < 0 {
+		return
+	}
+	closed = Min(closed, window.current_bucket_group+1)
+	for bucket_group := Max(window.closed_bucket_group, window.current_bucket_group-window.len()+1); bucket_group < closed; bucket_group++ {
+		if state := window.buckets[window.index(bucket_group)].State; state != nil && window.on_close != nil {
+			window.on_close(window.id, bucket_group, state)
+		}
+	}
+	window.closed_bucket_group = Max(window.closed_bucket_group, closed)
 }
 
 /*
@@ -96,6 +147,9 @@ func (window *Window) update_time(t int64) {
  */
 func (window *Window) _update_time(t int64) {
 	if window.bucket_group(t) > window.current_bucket_group {
+		// the buckets leaving the window are final
+		window.close_buckets(window.bucket_group(t) - window.len() + 1)
+
 		var min_current_bucket_group int64 = 0
 		if window.bucket_group(t) > window.len() {
 			min_current_bucket_group = window.bucket_group(t) - window.len()
@@ -105,11 +159,11 @@ func (window *Window) _update_time(t int64) {
 			batch := window.db.NewBatch()
 			for bucket_group := Max(window.current_bucket_group, min_current_bucket_group) + 1; bucket_group <= window.bucket_group(t); bucket_group++ {
 				index := window.index(bucket_group)
-				batch.Set(window.bucket_keys[index], window.bytes_nil, nil)
+				batch.Delete(window.bucket_keys[index], nil)
 			}
-			batch.Set(window.current_bucket_group_key, window.safe_marshal(window.current_bucket_group), nil)
+			batch.Set(window.current_bucket_group_key, window.safe_marshal(window.bucket_group(t)), nil)
 
-			if err := batch.Commit(pebble.NoSync); err != nil {
+			if err := batch.Commit(window.write_options); err != nil {
 				logrus.Errorf("_update_time commit %s %s: %+v", window.namespace, window.id, err)
 			}
 		}
@@ -133,10 +187,7 @@ func (window *Window) check_unused() bool {
 
 func (window *Window) delete_window(batch *pebble.Batch) {
 	if window.db != nil {
-		batch.Delete(window.current_bucket_group_key, nil)
-		for _, bucket_key := range window.bucket_keys {
-			batch.Delete(bucket_key, nil)
-		}
+		batch.DeleteRange(window.prefix, prefix_end(window.prefix), nil)
 	}
 }
 
@@ -164,90 +215,37 @@ func (window *Window) get_representation() []any {
  */
 
 func (window *Window) generate_constants() {
+	window.prefix = window_prefix(window.namespace, window.generation, window.id)
+
 	// current_bucket_group key
-	key_current_bucket_group := []byte(fmt.Sprintf("%s/%s/current_bucket_group", window.namespace, window.id))
-	window.current_bucket_group_key = key_current_bucket_group
+	window.current_bucket_group_key = current_bucket_group_key(window.namespace, window.generation, window.id)
 
 	// buckets key
 	key_buckets := make([][]byte, window.len())
 	for t := range window.buckets {
-		key_buckets[t] = []byte(fmt.Sprintf("%s/%s/%d", window.namespace, window.id, t))
+		key_buckets[t] = bucket_key(window.namespace, window.generation, window.id, t)
 	}
 	window.bucket_keys = key_buckets
-
-	// bytes_nil constandt
-	window.bytes_nil, _ = json.Marshal(nil)
 }
 
 /*
  *	Loads/Persistence
  */
 
+// buckets without a key have no state
 func (window *Window) activate_cached_persistence() {
-	batch := window.db.NewBatch()
-	batch.Set(window.current_bucket_group_key, window.safe_marshal(0), nil)
-
-	for _, bucket_key := range window.bucket_keys {
-		batch.Set(bucket_key, window.bytes_nil, nil)
-	}
-
-	if err := batch.Commit(pebble.NoSync); err != nil {
+	if err := window.db.Set(window.current_bucket_group_key, window.safe_marshal(window.current_bucket_group), window.write_options); err != nil {
 		window.db = nil
 		logrus.Errorf("window activate_cached_persistence commit failed (using only memmory) %s %s: %v", window.namespace, window.id, err)
 	}
 }
 
-func (window *Window) try_load_from_db() (ok bool) {
-
-	db_current_bucket_group, closer, err := window.db.Get(window.current_bucket_group_key)
-	if err == pebble.ErrNotFound {
-		return false
-	} else if err != nil {
-		logrus.Errorf("window try_load_from_db %s %s: %+v", window.namespace, window.id, err)
-		return false
-	}
-
-	var current_bucket_group int64
-	window.safe_unmarshal(db_current_bucket_group, &current_bucket_group)
-
-	if err := closer.Close(); err != nil {
-		logrus.Errorf("window try_load_from_db close current_bucket_group %s %s: %+v", window.namespace, window.id, err)
-	}
-
-	if window.try_load_buckets_from_db() {
-		window.current_bucket_group = current_bucket_group
-		return true
-	} else {
-		return false
-	}
-}
-
-func (window *Window) try_load_buckets_from_db() (ok bool) {
-	for i := range window.buckets {
-		db_bucket, closer, err := window.db.Get(window.bucket_keys[i])
-		var state any
-		if err != nil {
-			logrus.Errorf("window try_load_buckets_from_db Get %d - %s %s: %+v", i, window.namespace, window.id, err)
-			// Not need to undo the buckets already set because the current_cucket_group is 0 and will clrear the buckets before using them
-			return false
-		} else {
-			window.safe_unmarshal(db_bucket, &state)
-			if err := closer.Close(); err != nil {
-				logrus.Errorf("window try_load_buckets_from_db close bucket %d - %s %s: %+v", i, window.namespace, window.id, err)
-			}
-
-			window.buckets[i].State = state
-		}
-	}
-	return true
-}
-
 /*
  *	Marshal
  */
 
 func (window *Window) safe_marshal(v any) []byte {
-	b, err := json.Marshal(v)
+	b, err := window.codec.marshal(v)
 	if err != nil {
 		logrus.Errorf("window safe marshal %s %s: %+v", window.namespace, window.id, err)
 		return []byte("")
@@ -255,15 +253,6 @@ func (window *Window) safe_marshal(v any) []byte {
 	return b
 }
 
-func (window *Window) safe_unmarshal(b []byte, v any) any {
-	err := json.Unmarshal(b, v)
-	if err != nil {
-		logrus.Errorf("window safe unmarshal %s %s: %+v", window.namespace, window.id, err)
-		return nil
-	}
-	return v
-}
-
 //
 
 func Max(x, y int64) int64 {
@@ -272,3 +261,10 @@ func Max(x, y int64) int64 {
 	}
 	return x
 }
+
+func Min(x, y int64) int64 {
+	if x > y {
+		return y
+	}
+	return x
+}
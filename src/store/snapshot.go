@@ -0,0 +1,182 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"path/filepath"
+	"reflect"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+/*
+ * Snapshot - portable state of a store, independent of how (and if) it is persisted
+ */
+type Snapshot struct {
+	Namespace    string                      `json:"namespace"`
+	Granularity  int64                       `json:"granularity"`
+	Cardinality  int64                       `json:"cardinality"`
+	Time_unit    string                      `json:"time_unit"`
+	Current_time int64                       `json:"current_time"`
+	Windows      map[string]*Window_snapshot `json:"windows"`
+}
+
+type Window_snapshot struct {
+	Current_bucket_group int64 `json:"current_bucket_group"`
+	// buckets with a state, oldest first
+	Buckets []Bucket_snapshot `json:"buckets"`
+}
+
+type Bucket_snapshot struct {
+	Bucket_group int64 `json:"bucket_group"`
+	State        any   `json:"state"`
+}
+
+/*
+ * Checks a snapshot before it is imported: every bucket group >= 0, oldest first
+ * and in the window (cardinality+1 bucket groups) ending at the current bucket group
+ */
+func (snapshot *Snapshot) Validate() error {
+	if snapshot.Granularity <= 0 {
+		return fmt.Errorf("snapshot granularity must be > 0")
+	}
+	if snapshot.Cardinality <= 0 {
+		return fmt.Errorf("snapshot cardinality must be > 0")
+	}
+	if snapshot.Current_time < 0 {
+		return fmt.Errorf("snapshot current_time must be >= 0")
+	}
+
+	length := snapshot.Cardinality + 1
+	for id, window := range snapshot.Windows {
+		if window == nil {
+			return fmt.Errorf("snapshot window %s is null", id)
+		}
+		if window.Current_bucket_group < 0 {
+			return fmt.Errorf("snapshot window %s: current_bucket_group must be >= 0", id)
+		}
+		if int64(len(window.Buckets)) > length {
+			return fmt.Errorf("snapshot window %s: %d buckets, at most cardinality+1 (%d)", id, len(window.Buckets), length)
+		}
+		for i, bucket := range window.Buckets {
+			if bucket.Bucket_group < 0 || bucket.Bucket_group > window.Current_bucket_group || bucket.Bucket_group <= window.Current_bucket_group-length {
+				return fmt.Errorf("snapshot window %s: bucket_group %d not in the window of current_bucket_group %d", id, bucket.Bucket_group, window.Current_bucket_group)
+			}
+			if i > 0 && bucket.Bucket_group <= window.Buckets[i-1].Bucket_group {
+				return fmt.Errorf("snapshot window %s: buckets not oldest first (bucket_group %d after %d)", id, bucket.Bucket_group, window.Buckets[i-1].Bucket_group)
+			}
+		}
+	}
+
+	return nil
+}
+
+/*
+ * Snapshot formats: json - cbor
+ */
+
+var snapshot_cbor_decoding, _ = cbor.DecOptions{
+	DefaultMapType: reflect.TypeOf(map[string]any(nil)),
+	// *big.Int as gojq
+	BigIntDec: cbor.BigIntDecodePointer,
+}.DecMode()
+
+// by the extension of path (.cbor), json otherwise
+func Snapshot_format(path string) string {
+	if filepath.Ext(path) == ".cbor" {
+		return "cbor"
+	}
+	return "json"
+}
+
+func Encode_snapshot(snapshot *Snapshot, format string) ([]byte, error) {
+	switch format {
+	case "json":
+		return json.Marshal(snapshot)
+	case "cbor":
+		return cbor.Marshal(snapshot)
+	default:
+		return nil, fmt.Errorf("Encode_snapshot: %s is not a valid format (json - cbor)", format)
+	}
+}
+
+func Decode_snapshot(buf []byte, format string) (*Snapshot, error) {
+	var snapshot Snapshot
+	var err error
+
+	switch format {
+	case "json":
+		err = decode_json_snapshot(buf, &snapshot)
+	case "cbor":
+		err = snapshot_cbor_decoding.Unmarshal(buf, &snapshot)
+	default:
+		return nil, fmt.Errorf("Decode_snapshot: %s is not a valid format (json - cbor)", format)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Decode_snapshot %s: %w", format, err)
+	}
+
+	return &snapshot, nil
+}
+
+// integers stay exact (above 2^53 too): the json numbers of the states are decoded as int64, big.Int or float64
+func decode_json_snapshot(buf []byte, snapshot *Snapshot) error {
+	decoder := json.NewDecoder(bytes.NewReader(buf))
+	decoder.UseNumber()
+	if err := decoder.Decode(snapshot); err != nil {
+		return err
+	}
+	if decoder.More() {
+		return fmt.Errorf("data after the snapshot")
+	}
+
+	for _, window := range snapshot.Windows {
+		if window == nil {
+			continue
+		}
+		for i := range window.Buckets {
+			state, err := From_json_numbers(window.Buckets[i].State)
+			if err != nil {
+				return fmt.Errorf("bucket %d: %w", window.Buckets[i].Bucket_group, err)
+			}
+			window.Buckets[i].State = state
+		}
+	}
+	return nil
+}
+
+// json.Number (decoder.UseNumber) in v to int64, *big.Int or float64 (a json.Number would be a string in cbor)
+func From_json_numbers(v any) (any, error) {
+	switch tv := v.(type) {
+	case json.Number:
+		if n, err := tv.Int64(); err == nil {
+			return n, nil
+		}
+		if n, ok := new(big.Int).SetString(tv.String(), 10); ok {
+			return n, nil
+		}
+		return tv.Float64()
+	case map[string]any:
+		for key, value := range tv {
+			value, err := From_json_numbers(value)
+			if err != nil {
+				return nil, err
+			}
+			tv[key] = value
+		}
+		return tv, nil
+	case []any:
+		for i, value := range tv {
+			value, err := From_json_numbers(value)
+			if err != nil {
+				return nil, err
+			}
+			tv[i] = value
+		}
+		return tv, nil
+	default:
+		return v, nil
+	}
+}
@@ -1,27 +1,72 @@
 package store
 
 import (
+	"context"
+
 	"github.com/itchyny/gojq"
 )
 
 type Store interface {
 	/*
 	 *	id - Name of the window
-	 *  t - unix timestamp the metric occoured
+	 *  t - timestamp the metric occoured (in the store time unit since the unix epoch)
 	 * 	metrc - metric to add using lambda
-	 *	lamba - f(current_state, new_metric) new_state
+	 *	lamba - f(current_state, new_metric) new_state, run with ctx
+	 *	returns false if t is older than the window of id (the metric is dropped)
 	 */
-	Push(id string, t int64, metric any, lambda *gojq.Code)
+	Push(ctx context.Context, id string, t int64, metric any, lambda *gojq.Code) bool
 
 	/*
-	 *	t - current unix timestamp
+	 *	t - current timestamp (in the store time unit)
 	 */
 	Tick(t int64)
 
+	/*
+	 *	returns the time of the last tick
+	 */
+	Current_time() int64
+
 	/*
 	 * returns a representation of the store, and the current store time
 	 */
 	Get_representation() (map[string]any, int64)
+
+	/*
+	 *	track - keep the closed buckets (with a state) until Closed_buckets
+	 *	allowed_lateness - a bucket is closed once the store time passes its end plus allowed_lateness
+	 *	(nil: once it leaves the window), so no metric can be pushed to it anymore
+	 */
+	Set_track_closed_buckets(track bool, allowed_lateness *int64)
+
+	/*
+	 *	returns and forgets the buckets closed since the last call
+	 */
+	Closed_buckets() []Closed_bucket
+
+	/*
+	 *	returns the full state of the store
+	 */
+	Export() *Snapshot
+
+	/*
+	 *	replaces the full state of the store (resampled if the granularity or time_unit differs)
+	 */
+	Import(snapshot *Snapshot) error
+
+	/*
+	 *	stops the store for next (reload): waits for the calls in progress, calls next with the state
+	 *	of the store and forwards every later call to the store it returns (nil keeps the store running)
+	 */
+	Hand_over(next func(snapshot *Snapshot) Store) Store
+}
+
+/*
+ * Closed_bucket - final state of a bucket of a window once it is closed (see Set_track_closed_buckets)
+ */
+type Closed_bucket struct {
+	Id           string
+	Bucket_start int64
+	State        any
 }
 
 type Store_factory interface {